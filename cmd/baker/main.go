@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alinz/baker/container"
@@ -16,6 +19,14 @@ func main() {
 	acmeEnable := os.Getenv("BAKER_ACME") == "true"
 	acmePath := os.Getenv("BAKER_ACME_PATH")
 	debugLevel := os.Getenv("BAKER_DEBUG_LEVEL") == "true"
+	affinitySecret := os.Getenv("BAKER_AFFINITY_SECRET")
+	statusAddr := os.Getenv("BAKER_STATUS_ADDR")
+	producer := os.Getenv("BAKER_PRODUCER")
+	recordPath := os.Getenv("BAKER_RECORD")
+
+	if producer == "" {
+		producer = "docker"
+	}
 
 	if acmePath == "" {
 		acmePath = "."
@@ -25,16 +36,69 @@ func main() {
 		logger.Level = logger.DEBUG_LEVEL
 	}
 
+	if affinitySecret != "" {
+		gateway.AffinitySecret = []byte(affinitySecret)
+	}
+
 	proxy := gateway.NewHandler()
 
-	containerProducer := container.NewDocker(container.DefaultClient, container.DefaultAddr)
-	serviceProducer := service.New(service.NewConfigLoader(nil), 10*time.Second)
+	// multiple producers can be used at the same time, e.g. docker,file
+	names := strings.Split(producer, ",")
+
+	producers := make(map[string]container.Producer, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		p, err := newProducer(name)
+		if err != nil {
+			logger.Error("failed to create producer '%s' because %s", name, err)
+			return
+		}
+
+		producers[name] = p
+	}
+
+	var containerProducer container.Producer = container.NewMulti(producers)
+	if len(producers) == 1 {
+		containerProducer = producers[strings.TrimSpace(names[0])]
+	}
+
+	// containers can be recorded, so issues can be reproduced by replay producer.
+	// recording is truncated, so it only has one session and replay's clock starts from its beginning
+	if recordPath != "" {
+		recording, err := os.OpenFile(recordPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			logger.Error("failed to open %s because %s", recordPath, err)
+			return
+		}
+		defer recording.Close()
+
+		containerProducer = container.NewRecorder(containerProducer, recording)
+	}
+
+	// inline config has the highest priority and
+	// labels have higher priority than ping endpoint
+	configLoader := service.ConfigLoaders{
+		service.NewStaticConfigLoader(),
+		service.NewLabelConfigLoader(),
+		service.NewConfigLoader(nil),
+	}
+
+	serviceProducer := service.New(configLoader, 10*time.Second)
 
 	// container -> service producer -> service
 	go containerProducer.Pipe(serviceProducer)
 	// service -> proxy -> create a map
 	go serviceProducer.Pipe(proxy)
 
+	if statusAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(statusAddr, proxy.StatusHandler()); err != nil {
+				logger.Error("status server failed because %s", err)
+			}
+		}()
+	}
+
 	if !acmeEnable {
 		if err := http.ListenAndServe(":80", proxy); err != nil {
 			logger.Error(err.Error())
@@ -47,3 +111,106 @@ func main() {
 		logger.Error(err.Error())
 	}
 }
+
+// newProducer creates a container producer by its name
+func newProducer(name string) (container.Producer, error) {
+	switch name {
+	case "docker", "swarm":
+		// BAKER_DOCKER_* override DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH,
+		// so baker can use a different daemon than other tools on the same host.
+		// BAKER_DOCKER_TLS_VERIFY which is set to empty turns verification off
+		var tlsVerify *bool
+		if value, ok := os.LookupEnv("BAKER_DOCKER_TLS_VERIFY"); ok {
+			verify := value != ""
+			tlsVerify = &verify
+		}
+
+		client, addr, err := container.NewDockerClient(container.DockerConfig{
+			Host:      os.Getenv("BAKER_DOCKER_HOST"),
+			TLSVerify: tlsVerify,
+			CertPath:  os.Getenv("BAKER_DOCKER_CERT_PATH"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "swarm" {
+			return container.NewSwarm(client, addr, 5*time.Second), nil
+		}
+
+		return container.NewDocker(client, addr), nil
+
+	case "file":
+		return container.NewFile(os.Getenv("BAKER_FILE"), 2*time.Second), nil
+
+	case "consul":
+		addr := os.Getenv("CONSUL_HTTP_ADDR")
+		if addr == "" {
+			addr = "http://127.0.0.1:8500"
+		}
+
+		return container.NewConsul(&http.Client{}, addr), nil
+
+	case "kubernetes":
+		client, addr, err := container.NewKubernetesInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return container.NewKubernetes(client, addr, os.Getenv("BAKER_KUBERNETES_NAMESPACE")), nil
+
+	case "dns":
+		targets, err := container.ParseDNSTargets(os.Getenv("BAKER_DNS"), os.Getenv("BAKER_DNS_PING"))
+		if err != nil {
+			return nil, err
+		}
+
+		// nameservers are queried directly, so each name is resolved again once its records' TTL passes
+		config, err := container.DNSConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+
+		return container.NewDNS(container.NewDNSResolver(config), targets), nil
+
+	case "replay":
+		speed := 1.0
+		if value := os.Getenv("BAKER_REPLAY_SPEED"); value != "" {
+			var err error
+			speed, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		recording, err := os.Open(os.Getenv("BAKER_REPLAY"))
+		if err != nil {
+			return nil, err
+		}
+
+		return container.NewReplay(recording, speed), nil
+
+	case "registry":
+		token := os.Getenv("BAKER_REGISTRY_TOKEN")
+		if token == "" {
+			return nil, errors.New("BAKER_REGISTRY_TOKEN is required")
+		}
+
+		addr := os.Getenv("BAKER_REGISTRY_ADDR")
+		if addr == "" {
+			addr = ":8090"
+		}
+
+		registry := container.NewRegistry(token)
+
+		go func() {
+			if err := http.ListenAndServe(addr, registry); err != nil {
+				logger.Error("registry server failed because %s", err)
+			}
+		}()
+
+		return registry, nil
+	}
+
+	return nil, errors.New("producer is not supported")
+}
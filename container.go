@@ -0,0 +1,46 @@
+package baker
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Equal checks whether containers are the same, including their addresses,
+// tls settings, labels, inline config and error. Producers and ProduceService
+// use it to only pass changed containers
+func (c *Container) Equal(other *Container) bool {
+	if c == other {
+		return true
+	}
+
+	if c == nil || other == nil {
+		return false
+	}
+
+	if c.ID != other.ID || c.Active != other.Active || errString(c.Err) != errString(other.Err) {
+		return false
+	}
+
+	return addrString(c.Addr) == addrString(other.Addr) &&
+		addrString(c.PingAddr) == addrString(other.PingAddr) &&
+		reflect.DeepEqual(c.TLS, other.TLS) &&
+		reflect.DeepEqual(c.Labels, other.Labels) &&
+		reflect.DeepEqual(c.Config, other.Config)
+}
+
+// addrString returns addr's string, or an empty string if addr is nil
+func addrString(addr fmt.Stringer) string {
+	if addr == nil || reflect.ValueOf(addr).IsNil() {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,149 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alinz/baker/pkg/endpoint"
+)
+
+// DefaultHost is the address of local Docker daemon
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// DockerConfig describes how to connect to Docker daemon
+type DockerConfig struct {
+	// Host is either unix:///path/to/docker.sock or tcp://host:port
+	Host string
+	// TLSVerify enables verifying daemon's certificate against ca.pem.
+	// nil means it's not set, so it can be read from environment
+	TLSVerify *bool
+	// CertPath is a folder which contains ca.pem, cert.pem and key.pem.
+	// if it's set, connection is over tls and cert.pem is used as client certificate
+	CertPath string
+}
+
+// DockerConfigFromEnv reads DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+// in the same way as docker cli does
+func DockerConfigFromEnv() DockerConfig {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+
+	config := DockerConfig{
+		Host:      os.Getenv("DOCKER_HOST"),
+		TLSVerify: &verify,
+		CertPath:  os.Getenv("DOCKER_CERT_PATH"),
+	}
+
+	return config.withDefaultCertPath()
+}
+
+// merge fills fields which are not set explicitly by other's. tls settings of other
+// belong to its host, so nothing is taken from other if host is set explicitly
+func (c DockerConfig) merge(other DockerConfig) DockerConfig {
+	if c.Host != "" {
+		return c
+	}
+
+	c.Host = other.Host
+
+	if c.TLSVerify == nil {
+		c.TLSVerify = other.TLSVerify
+	}
+
+	if c.CertPath == "" {
+		c.CertPath = other.CertPath
+	}
+
+	return c
+}
+
+// verify reports whether daemon's certificate needs to be verified
+func (c DockerConfig) verify() bool {
+	return c.TLSVerify != nil && *c.TLSVerify
+}
+
+// withDefaultCertPath uses ~/.docker, like docker cli, if tls is verified without a cert path
+func (c DockerConfig) withDefaultCertPath() DockerConfig {
+	if c.verify() && c.CertPath == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			c.CertPath = filepath.Join(home, ".docker")
+		}
+	}
+
+	return c
+}
+
+// NewDockerClient creates a client and an address which can be passed to NewDocker.
+// Fields of config which are not set are read from environment variables and if
+// DOCKER_HOST is not set either, local docker.sock is used
+func NewDockerClient(config DockerConfig) (*http.Client, string, error) {
+	config = config.merge(DockerConfigFromEnv()).withDefaultCertPath()
+
+	if config.Host == "" {
+		config.Host = DefaultHost
+	}
+
+	switch {
+	case strings.HasPrefix(config.Host, "unix://"):
+		socket := strings.TrimPrefix(config.Host, "unix://")
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+
+		return client, DefaultAddr, nil
+
+	case strings.HasPrefix(config.Host, "tcp://"):
+		host := strings.TrimPrefix(config.Host, "tcp://")
+		secure := config.verify() || config.CertPath != ""
+
+		// docker uses 2375 for plain and 2376 for tls connections by default
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			if secure {
+				host = net.JoinHostPort(host, "2376")
+			} else {
+				host = net.JoinHostPort(host, "2375")
+			}
+		}
+
+		if !secure {
+			return &http.Client{Transport: &http.Transport{}}, "http://" + host, nil
+		}
+
+		caFile := ""
+		if config.verify() {
+			caFile = filepath.Join(config.CertPath, "ca.pem")
+		}
+
+		certFile, keyFile := "", ""
+		if config.CertPath != "" {
+			certFile = filepath.Join(config.CertPath, "cert.pem")
+			keyFile = filepath.Join(config.CertPath, "key.pem")
+		}
+
+		tlsConfig, err := endpoint.NewTLSConfig(caFile, certFile, keyFile, "", !config.verify())
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load docker's certificates because %s", err)
+		}
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		}
+
+		return client, "https://" + host, nil
+	}
+
+	return nil, "", fmt.Errorf("docker host '%s' is not supported", config.Host)
+}
@@ -0,0 +1,239 @@
+package container_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+)
+
+// writeCerts writes daemon's certificate as ca.pem and a new client certificate
+// as cert.pem and key.pem, the same layout as DOCKER_CERT_PATH
+func writeCerts(t *testing.T, server *httptest.Server) (string, *x509.Certificate) {
+	dir, err := ioutil.TempDir("", "docker-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "baker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: server.Certificate().Raw},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	}
+
+	for name, block := range files {
+		err = ioutil.WriteFile(path.Join(dir, name), pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, cert
+}
+
+func TestNewDockerClientTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	certPath, clientCert := writeCerts(t, server)
+	defer os.RemoveAll(certPath)
+
+	// untrustedPath has a ca.pem which daemon's certificate is not signed by
+	untrustedPath, untrustedCert := writeCerts(t, server)
+	defer os.RemoveAll(untrustedPath)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	pool.AddCert(untrustedCert)
+	server.TLS.ClientCAs = pool
+
+	cert, err := ioutil.ReadFile(path.Join(untrustedPath, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(untrustedPath, "ca.pem"), cert, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := "tcp://" + strings.TrimPrefix(server.URL, "https://")
+	verify, skipVerify := true, false
+
+	testCases := []struct {
+		name   string
+		env    map[string]string
+		config container.DockerConfig
+		err    bool
+	}{
+		{
+			name: "from environment",
+			env: map[string]string{
+				"DOCKER_HOST":       host,
+				"DOCKER_TLS_VERIFY": "1",
+				"DOCKER_CERT_PATH":  certPath,
+			},
+		},
+		{
+			name: "explicit config overrides environment",
+			env: map[string]string{
+				"DOCKER_HOST":       "unix:///does/not/exist.sock",
+				"DOCKER_TLS_VERIFY": "",
+				"DOCKER_CERT_PATH":  "",
+			},
+			config: container.DockerConfig{
+				Host:      host,
+				TLSVerify: &verify,
+				CertPath:  certPath,
+			},
+		},
+		{
+			name: "explicit certificates are kept when host comes from environment",
+			env: map[string]string{
+				"DOCKER_HOST":       host,
+				"DOCKER_TLS_VERIFY": "",
+				"DOCKER_CERT_PATH":  "",
+			},
+			config: container.DockerConfig{
+				TLSVerify: &verify,
+				CertPath:  certPath,
+			},
+		},
+		{
+			name: "environment's certificates are not used for explicit host",
+			env: map[string]string{
+				"DOCKER_HOST":       host,
+				"DOCKER_TLS_VERIFY": "1",
+				"DOCKER_CERT_PATH":  certPath,
+			},
+			config: container.DockerConfig{
+				Host: host,
+			},
+			err: true,
+		},
+		{
+			name: "explicit config turns verification off",
+			env: map[string]string{
+				"DOCKER_HOST":       host,
+				"DOCKER_TLS_VERIFY": "1",
+				"DOCKER_CERT_PATH":  untrustedPath,
+			},
+			config: container.DockerConfig{
+				TLSVerify: &skipVerify,
+			},
+		},
+		{
+			name: "environment's verification is used when it's not set explicitly",
+			env: map[string]string{
+				"DOCKER_HOST":       host,
+				"DOCKER_TLS_VERIFY": "1",
+				"DOCKER_CERT_PATH":  untrustedPath,
+			},
+			err: true,
+		},
+		{
+			name: "plain connection is rejected",
+			config: container.DockerConfig{
+				Host: host,
+			},
+			err: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for key, value := range testCase.env {
+				previous, ok := os.LookupEnv(key)
+				os.Setenv(key, value)
+				defer func(key string) {
+					if ok {
+						os.Setenv(key, previous)
+					} else {
+						os.Unsetenv(key)
+					}
+				}(key)
+			}
+
+			client, addr, err := container.NewDockerClient(testCase.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(addr + "/containers/json")
+			if testCase.err {
+				// daemon either rejects the connection or the plain http request
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode == http.StatusOK {
+						t.Fatal("expected request to fail")
+					}
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestNewDockerClientUnsupportedHost(t *testing.T) {
+	_, _, err := container.NewDockerClient(container.DockerConfig{Host: "ssh://user@host"})
+	if err == nil {
+		t.Fatal("expected error for unsupported host")
+	}
+}
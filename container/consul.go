@@ -0,0 +1,355 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// ConsulTag is the tag which services need to have, so baker routes traffic to them
+const ConsulTag = "baker"
+
+// ConsulWait is the maximum duration which a blocking query waits for a change
+var ConsulWait = 5 * time.Minute
+
+// Consul is an implementation of container producer which watches Consul's catalog.
+// Each instance of a service tagged by ConsulTag is produced as a container. Service's
+// meta which starts with baker_ are used as labels, e.g. baker_domain becomes baker.domain,
+// except baker_port, baker_ping and baker_ssl which become baker.service.port, ping and ssl
+type Consul struct {
+	client   *http.Client
+	addr     endpoint.HTTPAddr
+	ctx      context.Context
+	cancel   context.CancelFunc
+	consumer Consumer
+	watchers map[string]*consulWatcher
+	// stopped keeps watchers which have been stopped, a new watcher
+	// of the same service waits until the previous one is done
+	stopped map[string]*consulWatcher
+	wg      sync.WaitGroup
+}
+
+// consulWatcher is a running watcher of a service. done is closed once
+// watcher has pushed all of its instances as inactive
+type consulWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ Producer = (*Consul)(nil)
+
+// Pipe starts watching Consul's catalog and pushes instances of services tagged by ConsulTag
+// NOTE: this method is blocking call
+func (c *Consul) Pipe(consumer Consumer) {
+	c.consumer = consumer
+
+	err := c.watchCatalog()
+
+	for _, watcher := range c.watchers {
+		watcher.cancel()
+	}
+	c.wg.Wait()
+
+	consumer.Close(err)
+}
+
+// Stop terminates watching Consul
+func (c *Consul) Stop() {
+	c.cancel()
+}
+
+// watchCatalog watches list of services and starts a watcher for each service tagged by ConsulTag.
+// error is returned only if catalog can't be read at first
+func (c *Consul) watchCatalog() error {
+	var index uint64
+	delay := ReconnectMinDelay
+	first := true
+
+	for {
+		services := make(map[string][]string)
+
+		next, err := c.query(c.ctx, "/v1/catalog/services", index, &services)
+		if c.ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			if first {
+				return err
+			}
+
+			logger.Warn("failed to watch consul's catalog because %s, retrying in %s", err, delay)
+			delay = c.backoff(c.ctx, delay)
+			continue
+		}
+
+		first = false
+		delay = ReconnectMinDelay
+		index = nextIndex(index, next)
+
+		c.updateWatchers(services)
+	}
+}
+
+// updateWatchers starts watching new services and stops watching services
+// which no longer exist or are no longer tagged by ConsulTag
+func (c *Consul) updateWatchers(services map[string][]string) {
+	for name, watcher := range c.stopped {
+		select {
+		case <-watcher.done:
+			delete(c.stopped, name)
+		default:
+		}
+	}
+
+	for name, tags := range services {
+		if _, ok := c.watchers[name]; ok || !containsString(tags, ConsulTag) {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(c.ctx)
+		watcher := &consulWatcher{
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		c.watchers[name] = watcher
+
+		// a service which has reappeared must not be pushed before
+		// its previous watcher has removed the old instances
+		previous := c.stopped[name]
+		delete(c.stopped, name)
+
+		c.wg.Add(1)
+		go c.watchService(ctx, name, watcher, previous)
+	}
+
+	for name, watcher := range c.watchers {
+		if tags, ok := services[name]; ok && containsString(tags, ConsulTag) {
+			continue
+		}
+
+		watcher.cancel()
+		delete(c.watchers, name)
+		c.stopped[name] = watcher
+	}
+}
+
+// watchService watches instances of a service and pushes the changes. Once watching the service is stopped,
+// because it's been removed from catalog, all of its instances are pushed as inactive. previous is
+// the stopped watcher of the same service, nothing is pushed until it's done
+func (c *Consul) watchService(ctx context.Context, name string, watcher *consulWatcher, previous *consulWatcher) {
+	defer c.wg.Done()
+	defer close(watcher.done)
+
+	if previous != nil {
+		select {
+		case <-previous.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	snapshot := newSnapshot()
+
+	defer func() {
+		// baker is shutting down
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		for _, container := range snapshot.update(nil) {
+			c.consumer.Container(container)
+		}
+	}()
+
+	var index uint64
+	delay := ReconnectMinDelay
+
+	for {
+		entries := []*consulEntry{}
+
+		next, err := c.query(ctx, "/v1/health/service/"+url.PathEscape(name), index, &entries)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			logger.Warn("failed to watch consul's service %s because %s, retrying in %s", name, err, delay)
+			delay = c.backoff(ctx, delay)
+			continue
+		}
+
+		delay = ReconnectMinDelay
+		index = nextIndex(index, next)
+
+		containers := make([]*baker.Container, 0, len(entries))
+		for _, entry := range entries {
+			// instances which are not passing their health checks, are removed
+			if !entry.passing() {
+				continue
+			}
+
+			containers = append(containers, entry.containers()...)
+		}
+
+		for _, container := range snapshot.update(containers) {
+			c.consumer.Container(container)
+		}
+	}
+}
+
+type consulEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+	Checks []struct {
+		Status string `json:"Status"`
+	} `json:"Checks"`
+}
+
+func (e *consulEntry) passing() bool {
+	for _, check := range e.Checks {
+		if check.Status != "passing" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// labels converts service's meta into labels
+func (e *consulEntry) labels() map[string]string {
+	labels := make(map[string]string)
+
+	if e.Service.Port > 0 {
+		labels[LabelServicePort] = strconv.Itoa(e.Service.Port)
+	}
+
+	for key, value := range e.Service.Meta {
+		if !strings.HasPrefix(key, "baker_") {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, "baker_")
+		switch name {
+		case "port", "ping", "ssl":
+			labels[LabelServicePrefix+name] = value
+		default:
+			labels["baker."+name] = value
+		}
+	}
+
+	return labels
+}
+
+// containers returns a container object for each endpoint of service's instance.
+// node's address is used if instance has no address
+func (e *consulEntry) containers() []*baker.Container {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+
+	// service's id is only unique within a node
+	id := e.Node.Node + "/" + e.Service.ID
+
+	containers := make([]*baker.Container, 0, 1)
+	for endpointID, labels := range endpointsLabels(id, e.labels()) {
+		containers = append(containers, containerFromLabels(endpointID, host, labels))
+	}
+
+	return containers
+}
+
+// query sends a blocking query which returns once index is changed or ConsulWait passed
+func (c *Consul) query(ctx context.Context, path string, index uint64, payload interface{}) (uint64, error) {
+	query := url.Values{}
+	query.Set("wait", ConsulWait.String())
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr.WithPath(path).String()+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to get %s, consul responded with status %d", path, resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse X-Consul-Index because %s", err)
+	}
+
+	return next, nil
+}
+
+// nextIndex returns index of next blocking query. Index needs to be reset
+// if it goes backward, e.g. once Consul's state is restored
+func nextIndex(previous, next uint64) uint64 {
+	if next < previous {
+		return 0
+	}
+
+	return next
+}
+
+// backoff waits for delay and returns the next delay
+func (c *Consul) backoff(ctx context.Context, delay time.Duration) time.Duration {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	delay *= 2
+	if delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+
+	return delay
+}
+
+// NewConsul creates a new Consul watcher, addr is the address of Consul's http api
+func NewConsul(client *http.Client, addr string) *Consul {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Consul{
+		client:   client,
+		addr:     endpoint.ParseHTTPAddr(addr),
+		ctx:      ctx,
+		cancel:   cancel,
+		watchers: make(map[string]*consulWatcher),
+		stopped:  make(map[string]*consulWatcher),
+	}
+}
@@ -0,0 +1,219 @@
+package container_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/container"
+)
+
+type consulInstance struct {
+	id     string
+	port   int
+	status string
+}
+
+// fakeConsul implements catalog and health apis with blocking queries
+type fakeConsul struct {
+	mux      sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string][]string
+	health   map[string][]*consulInstance
+}
+
+// update changes consul's state and unblocks waiting queries
+func (f *fakeConsul) update(fn func()) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	fn()
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mux.Lock()
+	if index >= f.index {
+		changed := f.changed
+		f.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+
+		f.mux.Lock()
+	}
+	defer f.mux.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+
+	if r.URL.Path == "/v1/catalog/services" {
+		json.NewEncoder(w).Encode(f.services)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	entries := make([]interface{}, 0)
+	for _, instance := range f.health[name] {
+		entries = append(entries, map[string]interface{}{
+			"Node": map[string]interface{}{"Node": "node-1", "Address": "10.0.0.1"},
+			"Service": map[string]interface{}{
+				"ID":      instance.id,
+				"Service": name,
+				"Address": "",
+				"Port":    instance.port,
+				"Meta": map[string]string{
+					"baker_ping":   "/config",
+					"baker_domain": "example.com",
+					"version":      "1.0.0",
+				},
+			},
+			"Checks": []map[string]string{
+				{"CheckID": "serfHealth", "Status": "passing"},
+				{"CheckID": "service:" + instance.id, "Status": instance.status},
+			},
+		})
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+func TestConsul(t *testing.T) {
+	container.ConsulWait = time.Second
+
+	consul := &fakeConsul{
+		index:   1,
+		changed: make(chan struct{}),
+		services: map[string][]string{
+			"web": {"baker", "v1"},
+			"db":  {"primary"},
+		},
+		health: map[string][]*consulInstance{
+			"web": {
+				{id: "web-1", port: 8000, status: "passing"},
+				{id: "web-2", port: 8001, status: "critical"},
+			},
+			"db": {
+				{id: "db-1", port: 5432, status: "passing"},
+			},
+		},
+	}
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	producer := container.NewConsul(server.Client(), server.URL)
+	consumer := pipe(t, producer)
+
+	web1 := consumer.expect("node-1/web-1", true)
+	if web1.Addr.String() != "10.0.0.1:8000" || web1.PingAddr.Path() != "/config" || web1.Labels["baker.domain"] != "example.com" {
+		t.Fatalf("unexpected container %+v", web1)
+	}
+
+	// web-2 passes its health check
+	consul.update(func() {
+		consul.health["web"][1].status = "passing"
+	})
+	consumer.expect("node-1/web-2", true)
+
+	// web-1 fails its health check
+	consul.update(func() {
+		consul.health["web"][0].status = "critical"
+	})
+	consumer.expect("node-1/web-1", false)
+
+	// web is deregistered
+	consul.update(func() {
+		delete(consul.services, "web")
+		delete(consul.health, "web")
+	})
+	consumer.expect("node-1/web-2", false)
+
+	producer.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulReappearedService(t *testing.T) {
+	container.ConsulWait = time.Second
+
+	consul := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: map[string][]string{"web": {"baker"}},
+		health: map[string][]*consulInstance{
+			"web": {{id: "web-1", port: 8000, status: "passing"}},
+		},
+	}
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	received := make(chan *baker.Container, 10)
+	removing := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	producer := container.NewConsul(server.Client(), server.URL)
+	go producer.Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			// removal of the stopped watcher is slow
+			if !container.Active {
+				removing <- struct{}{}
+				<-release
+			}
+			received <- container
+			return nil
+		},
+		close: func(err error) {},
+	})
+	defer producer.Stop()
+
+	expect := func(id string, active bool) {
+		select {
+		case c := <-received:
+			if c.ID != id || c.Active != active {
+				t.Fatalf("expected %s to be active=%t but got %+v", id, active, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s is not received", id)
+		}
+	}
+
+	expect("node-1/web-1", true)
+
+	consul.update(func() {
+		delete(consul.services, "web")
+	})
+	<-removing
+
+	// web reappears while its previous watcher is still removing web-1
+	consul.update(func() {
+		consul.services["web"] = []string{"baker"}
+	})
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	expect("node-1/web-1", false)
+	expect("node-1/web-1", true)
+}
@@ -0,0 +1,75 @@
+package container_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/container"
+)
+
+type DummyConsumer struct {
+	container func(container *baker.Container) error
+	close     func(err error)
+}
+
+var _ (container.Consumer) = (*DummyConsumer)(nil)
+
+func (dc *DummyConsumer) Container(container *baker.Container) error {
+	return dc.container(container)
+}
+
+func (dc *DummyConsumer) Close(err error) {
+	dc.close(err)
+}
+
+// testConsumer collects containers which are pushed by a producer
+// and the error which producer is closed with
+type testConsumer struct {
+	t        *testing.T
+	received chan *baker.Container
+	closed   chan error
+}
+
+// pipe runs producer's Pipe in background with a testConsumer
+func pipe(t *testing.T, producer container.Producer) *testConsumer {
+	consumer := &testConsumer{
+		t:        t,
+		received: make(chan *baker.Container, 10),
+		closed:   make(chan error, 1),
+	}
+
+	go producer.Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			consumer.received <- container
+			return nil
+		},
+		close: func(err error) {
+			consumer.closed <- err
+		},
+	})
+
+	return consumer
+}
+
+// next returns the next pushed container, test fails if nothing is pushed within 5 seconds
+func (c *testConsumer) next() *baker.Container {
+	select {
+	case container := <-c.received:
+		return container
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("container is not received")
+		return nil
+	}
+}
+
+// expect returns the next pushed container, which must be id with given
+// active state and without any error
+func (c *testConsumer) expect(id string, active bool) *baker.Container {
+	container := c.next()
+	if container.ID != id || container.Active != active || container.Err != nil {
+		c.t.Fatalf("expected %s to be active=%t but got %+v", id, active, container)
+	}
+
+	return container
+}
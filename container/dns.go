@@ -0,0 +1,222 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/interval"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Types of DNS records which can be resolved
+const (
+	DNSTypeA   = "a"
+	DNSTypeSRV = "srv"
+)
+
+// Each name is resolved again once the smallest TTL of its records passes.
+// TTLs are clamped between DNSMinTTL and DNSMaxTTL, and a name which fails to be
+// resolved, is retried after DNSMinTTL
+var (
+	DNSMinTTL = 1 * time.Second
+	DNSMaxTTL = 5 * time.Minute
+)
+
+// DNSTarget is a name which its records are produced as containers
+type DNSTarget struct {
+	Name string
+	// Type is either DNSTypeA, which resolves both A and AAAA records, or DNSTypeSRV
+	Type string
+	// Port is only used for A records, SRV records have their own ports
+	Port   int
+	SSL    bool
+	Ping   string
+	Labels map[string]string
+}
+
+// DNSRecord is a resolved address of a name
+type DNSRecord struct {
+	Host string
+	Port int
+	TTL  time.Duration
+}
+
+// DNSResolver resolves a target into records
+type DNSResolver interface {
+	Resolve(ctx context.Context, target *DNSTarget) ([]DNSRecord, error)
+}
+
+// dnsState holds the last records of a target
+type dnsState struct {
+	target     *DNSTarget
+	containers []*baker.Container
+	expires    time.Time
+}
+
+// DNS is an implementation of container producer which resolves names periodically
+// and produces a container for each record
+type DNS struct {
+	resolver DNSResolver
+	states   []*dnsState
+	ctx      context.Context
+	cancel   context.CancelFunc
+	consumer Consumer
+	snapshot *snapshot
+}
+
+var _ Producer = (*DNS)(nil)
+var _ interval.Ticker = (*DNS)(nil)
+
+// Pipe resolves all names and keeps resolving them once their TTLs pass
+// NOTE: this method is blocking call
+func (d *DNS) Pipe(consumer Consumer) {
+	d.consumer = consumer
+
+	// names might not be resolvable yet, e.g. compose services which are not started,
+	// so errors are only logged and resolving is retried
+	d.Tick(d.ctx)
+
+	// ticker only decides how often expired names are checked
+	interval.Run(d.ctx, d, DNSMinTTL)
+
+	consumer.Close(nil)
+}
+
+// Stop terminates resolving names
+func (d *DNS) Stop() {
+	d.cancel()
+}
+
+// Tick resolves names which their records have been expired and pushes the changes
+// NOTE: do not call this method, this will be called by interval.Run package.
+func (d *DNS) Tick(ctx context.Context) error {
+	now := time.Now()
+	changed := false
+
+	for _, state := range d.states {
+		if now.Before(state.expires) {
+			continue
+		}
+
+		records, err := d.resolver.Resolve(ctx, state.target)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("failed to resolve %s because %s", state.target.Name, err)
+			}
+
+			// previous records are kept until name can be resolved again
+			state.expires = now.Add(DNSMinTTL)
+			continue
+		}
+
+		state.containers = state.target.containers(records)
+		state.expires = now.Add(ttl(records))
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	containers := make([]*baker.Container, 0)
+	for _, state := range d.states {
+		containers = append(containers, state.containers...)
+	}
+
+	for _, container := range d.snapshot.update(containers) {
+		d.consumer.Container(container)
+	}
+
+	return nil
+}
+
+// ttl returns the smallest TTL of records
+func ttl(records []DNSRecord) time.Duration {
+	result := DNSMaxTTL
+	for _, record := range records {
+		if record.TTL < result {
+			result = record.TTL
+		}
+	}
+
+	if result < DNSMinTTL {
+		result = DNSMinTTL
+	}
+
+	return result
+}
+
+func (t *DNSTarget) containers(records []DNSRecord) []*baker.Container {
+	containers := make([]*baker.Container, 0, len(records))
+
+	for _, record := range records {
+		addr := endpoint.NewAddr(record.Host, record.Port, t.SSL)
+
+		containers = append(containers, &baker.Container{
+			ID:       t.Name + "/" + addr.String(),
+			Active:   true,
+			Addr:     addr,
+			PingAddr: endpoint.NewHTTPAddr(addr, t.Ping),
+			Labels:   t.Labels,
+		})
+	}
+
+	return containers
+}
+
+// ParseDNSTargets parses comma separated names. Names which start with underscore, such as
+// _http._tcp.api.example.com, are resolved as SRV records and others need a port, such as api:8000,
+// and are resolved as A records. All targets use given ping path
+func ParseDNSTargets(value string, ping string) ([]*DNSTarget, error) {
+	targets := make([]*DNSTarget, 0)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if strings.HasPrefix(name, "_") {
+			targets = append(targets, &DNSTarget{Name: name, Type: DNSTypeSRV, Ping: ping})
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse '%s' because %s", name, err)
+		}
+
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse port of '%s' because %s", name, err)
+		}
+
+		targets = append(targets, &DNSTarget{Name: host, Type: DNSTypeA, Port: p, Ping: ping})
+	}
+
+	return targets, nil
+}
+
+// NewDNS creates a producer which resolves targets using resolver
+func NewDNS(resolver DNSResolver, targets []*DNSTarget) *DNS {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	states := make([]*dnsState, 0, len(targets))
+	for _, target := range targets {
+		states = append(states, &dnsState{target: target})
+	}
+
+	return &DNS{
+		resolver: resolver,
+		states:   states,
+		ctx:      ctx,
+		cancel:   cancel,
+		snapshot: newSnapshot(),
+	}
+}
@@ -0,0 +1,354 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errNoSuchName is returned once nameserver reports that name doesn't exist
+var errNoSuchName = errors.New("no such name")
+
+// DNSConfig describes nameservers which names are resolved by, in the same way as resolv.conf
+type DNSConfig struct {
+	// Servers are addresses of nameservers, such as 10.0.0.2:53
+	Servers []string
+	// Search domains are tried for names which have fewer dots than NDots
+	Search []string
+	NDots  int
+	// Timeout is how long each nameserver is waited for
+	Timeout time.Duration
+}
+
+// DNSConfigFromFile reads nameserver, search, domain and ndots and timeout options
+// of a resolv.conf file. Same as Go's resolver, local nameserver is used if none is set
+func DNSConfigFromFile(filename string) (*DNSConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &DNSConfig{
+		NDots:   1,
+		Timeout: 5 * time.Second,
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			config.Servers = append(config.Servers, net.JoinHostPort(fields[1], "53"))
+		case "domain":
+			config.Search = []string{fields[1]}
+		case "search":
+			config.Search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				key, value := option, ""
+				if i := strings.Index(option, ":"); i >= 0 {
+					key, value = option[:i], option[i+1:]
+				}
+
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					continue
+				}
+
+				switch key {
+				case "ndots":
+					config.NDots = n
+				case "timeout":
+					config.Timeout = time.Duration(n) * time.Second
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(config.Servers) == 0 {
+		config.Servers = []string{"127.0.0.1:53"}
+	}
+
+	return config, nil
+}
+
+// names returns the fully qualified names which are tried for name, in the same order as Go's resolver
+func (c *DNSConfig) names(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+
+	names := make([]string, 0, len(c.Search)+1)
+
+	rooted := strings.Count(name, ".") >= c.NDots
+	if rooted {
+		names = append(names, name+".")
+	}
+
+	for _, search := range c.Search {
+		names = append(names, name+"."+strings.Trim(search, ".")+".")
+	}
+
+	if !rooted {
+		names = append(names, name+".")
+	}
+
+	return names
+}
+
+// dnsClient resolves names by querying nameservers directly, since Go's
+// resolver doesn't expose records' TTL
+type dnsClient struct {
+	config *DNSConfig
+}
+
+func (c *dnsClient) Resolve(ctx context.Context, target *DNSTarget) ([]DNSRecord, error) {
+	var err error
+
+	for _, name := range c.config.names(target.Name) {
+		var records []DNSRecord
+
+		records, err = c.resolve(ctx, name, target)
+		if err == nil {
+			return records, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("failed to resolve %s because %s", target.Name, err)
+}
+
+// resolve returns the records of a fully qualified name
+func (c *dnsClient) resolve(ctx context.Context, name string, target *DNSTarget) ([]DNSRecord, error) {
+	records := make([]DNSRecord, 0)
+
+	switch target.Type {
+	case DNSTypeSRV:
+		answers, ttl, err := c.query(ctx, name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, answer := range answers {
+			if srv, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+				records = append(records, DNSRecord{
+					Host: strings.TrimSuffix(srv.Target.String(), "."),
+					Port: int(srv.Port),
+					TTL:  minTTL(answer.Header.TTL, ttl),
+				})
+			}
+		}
+
+	case DNSTypeA:
+		var errs []error
+
+		// both A and AAAA records are resolved, name only fails if both of them fail
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			answers, ttl, err := c.query(ctx, name, qtype)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			for _, answer := range answers {
+				var ip net.IP
+
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					ip = net.IP(body.A[:])
+				case *dnsmessage.AAAAResource:
+					ip = net.IP(body.AAAA[:])
+				default:
+					continue
+				}
+
+				records = append(records, DNSRecord{
+					Host: ip.String(),
+					Port: target.Port,
+					TTL:  minTTL(answer.Header.TTL, ttl),
+				})
+			}
+		}
+
+		if len(errs) == 2 {
+			return nil, errs[0]
+		}
+
+	default:
+		return nil, fmt.Errorf("dns type '%s' is not supported", target.Type)
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records found for %s", name)
+	}
+
+	return records, nil
+}
+
+// query asks nameservers, in order, for records of name. ttl is the smallest TTL of CNAMEs in
+// the answer, which records of the aliased name can't outlive. Once a nameserver answers, or
+// reports that name doesn't exist, the others are not asked
+func (c *dnsClient) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, uint32, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = errors.New("no nameserver is configured")
+
+	for _, server := range c.config.Servers {
+		var response *dnsmessage.Message
+
+		response, err = c.exchange(ctx, server, "udp", packed, request.ID)
+		if err == nil && response.Truncated {
+			// answer doesn't fit in a udp packet
+			response, err = c.exchange(ctx, server, "tcp", packed, request.ID)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			continue
+		}
+
+		switch response.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, 0, errNoSuchName
+		default:
+			err = fmt.Errorf("nameserver %s responded with %s", server, response.RCode)
+			continue
+		}
+
+		ttl := ^uint32(0)
+		for _, answer := range response.Answers {
+			if answer.Header.Type == dnsmessage.TypeCNAME && answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+		}
+
+		return response.Answers, ttl, nil
+	}
+
+	return nil, 0, err
+}
+
+// exchange sends a packed request to server over network and reads its response.
+// Over tcp, messages are prefixed by their length
+func (c *dnsClient) exchange(ctx context.Context, server string, network string, request []byte, id uint16) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var buffer []byte
+
+	if network == "tcp" {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(request)))
+
+		_, err = conn.Write(append(length, request...))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer = make([]byte, binary.BigEndian.Uint16(length))
+		_, err = io.ReadFull(conn, buffer)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer = make([]byte, 65535)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		buffer = buffer[:n]
+	}
+
+	response := &dnsmessage.Message{}
+	err = response.Unpack(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Response || response.ID != id {
+		return nil, fmt.Errorf("nameserver %s responded with an unexpected message", server)
+	}
+
+	return response, nil
+}
+
+// minTTL returns the smaller of two TTLs in seconds as a duration
+func minTTL(a uint32, b uint32) time.Duration {
+	if b < a {
+		a = b
+	}
+
+	return time.Duration(a) * time.Second
+}
+
+// NewDNSResolver creates a resolver which queries config's nameservers directly,
+// so each record is resolved again once its own TTL passes
+func NewDNSResolver(config *DNSConfig) DNSResolver {
+	return &dnsClient{
+		config: config,
+	}
+}
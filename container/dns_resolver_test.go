@@ -0,0 +1,248 @@
+package container_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/alinz/baker/container"
+)
+
+// fakeNameserver answers queries with scripted records over both udp and tcp.
+// Truncated names are only answered over tcp
+type fakeNameserver struct {
+	records   map[string][]dnsmessage.Resource
+	truncated map[string]bool
+}
+
+func (f *fakeNameserver) answer(t *testing.T, request []byte, tcp bool) []byte {
+	var message dnsmessage.Message
+	err := message.Unpack(request)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	question := message.Questions[0]
+	name := question.Name.String()
+
+	message.Response = true
+
+	answers, ok := f.records[name]
+	switch {
+	case !ok:
+		message.RCode = dnsmessage.RCodeNameError
+	case f.truncated[name] && !tcp:
+		message.Truncated = true
+	default:
+		for _, answer := range answers {
+			if answer.Header.Type == question.Type || answer.Header.Type == dnsmessage.TypeCNAME {
+				message.Answers = append(message.Answers, answer)
+			}
+		}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+
+	return response
+}
+
+// serve starts fake nameserver on a random port of localhost and returns its address
+func (f *fakeNameserver) serve(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(f.answer(t, buffer[:n], false), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			length := make([]byte, 2)
+			io.ReadFull(c, length)
+
+			request := make([]byte, binary.BigEndian.Uint16(length))
+			io.ReadFull(c, request)
+
+			response := f.answer(t, request, true)
+			binary.BigEndian.PutUint16(length, uint16(len(response)))
+			c.Write(append(length, response...))
+			c.Close()
+		}
+	}()
+
+	return listener.Addr().String(), func() {
+		listener.Close()
+		conn.Close()
+	}
+}
+
+func dnsName(t *testing.T, name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func dnsResource(t *testing.T, name string, qtype dnsmessage.Type, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsName(t, name), Type: qtype, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	fake := &fakeNameserver{
+		records: map[string][]dnsmessage.Resource{
+			"web.example.com.": {
+				dnsResource(t, "web.example.com.", dnsmessage.TypeA, 10, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+				dnsResource(t, "web.example.com.", dnsmessage.TypeAAAA, 20, &dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}}),
+			},
+			"_http._tcp.api.example.com.": {
+				dnsResource(t, "_http._tcp.api.example.com.", dnsmessage.TypeSRV, 60,
+					&dnsmessage.SRVResource{Target: dnsName(t, "api-1.example.com."), Port: 9000}),
+			},
+			// TTL of alias caps TTL of records it leads to
+			"alias.example.com.": {
+				dnsResource(t, "alias.example.com.", dnsmessage.TypeCNAME, 5, &dnsmessage.CNAMEResource{CNAME: dnsName(t, "web.example.com.")}),
+				dnsResource(t, "web.example.com.", dnsmessage.TypeA, 10, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+			},
+		},
+		truncated: map[string]bool{
+			"_http._tcp.api.example.com.": true,
+		},
+	}
+
+	addr, stop := fake.serve(t)
+	defer stop()
+
+	resolver := container.NewDNSResolver(&container.DNSConfig{
+		Servers: []string{addr},
+		Search:  []string{"example.com"},
+		NDots:   1,
+		Timeout: time.Second,
+	})
+
+	testCases := []struct {
+		target   *container.DNSTarget
+		expected []container.DNSRecord
+		err      bool
+	}{
+		{
+			// search domain is tried for names without dots
+			target: &container.DNSTarget{Name: "web", Type: container.DNSTypeA, Port: 8000},
+			expected: []container.DNSRecord{
+				{Host: "10.0.0.1", Port: 8000, TTL: 10 * time.Second},
+				{Host: "::1", Port: 8000, TTL: 20 * time.Second},
+			},
+		},
+		{
+			target: &container.DNSTarget{Name: "alias.example.com", Type: container.DNSTypeA, Port: 8000},
+			expected: []container.DNSRecord{
+				{Host: "10.0.0.1", Port: 8000, TTL: 5 * time.Second},
+			},
+		},
+		{
+			// truncated answer is read again over tcp
+			target: &container.DNSTarget{Name: "_http._tcp.api.example.com", Type: container.DNSTypeSRV},
+			expected: []container.DNSRecord{
+				{Host: "api-1.example.com", Port: 9000, TTL: 60 * time.Second},
+			},
+		},
+		{
+			target: &container.DNSTarget{Name: "missing.example.com", Type: container.DNSTypeA, Port: 8000},
+			err:    true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		records, err := resolver.Resolve(context.Background(), testCase.target)
+		if testCase.err {
+			if err == nil {
+				t.Fatalf("expected %s not to be resolved", testCase.target.Name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Slice(records, func(i, j int) bool { return records[i].Host < records[j].Host })
+		if !reflect.DeepEqual(records, testCase.expected) {
+			t.Fatalf("expected %s to be resolved to %+v but got %+v", testCase.target.Name, testCase.expected, records)
+		}
+	}
+}
+
+func TestDNSConfigFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baker-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "resolv.conf")
+	err = ioutil.WriteFile(filename, []byte(strings.Join([]string{
+		"# kubernetes pod",
+		"nameserver 10.96.0.10",
+		"nameserver fd00::10",
+		"search default.svc.cluster.local svc.cluster.local",
+		"options ndots:5 timeout:2",
+	}, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := container.DNSConfigFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &container.DNSConfig{
+		Servers: []string{"10.96.0.10:53", "[fd00::10]:53"},
+		Search:  []string{"default.svc.cluster.local", "svc.cluster.local"},
+		NDots:   5,
+		Timeout: 2 * time.Second,
+	}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, config)
+	}
+}
@@ -0,0 +1,101 @@
+package container_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+)
+
+type dnsResponse struct {
+	records []container.DNSRecord
+	err     error
+}
+
+// fakeResolver returns scripted responses of each name, the last response is repeated
+type fakeResolver struct {
+	mux       sync.Mutex
+	responses map[string][]dnsResponse
+	calls     map[string]int
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, target *container.DNSTarget) ([]container.DNSRecord, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	responses := f.responses[target.Name]
+	i := f.calls[target.Name]
+	if i >= len(responses) {
+		i = len(responses) - 1
+	}
+	f.calls[target.Name]++
+
+	return responses[i].records, responses[i].err
+}
+
+func (f *fakeResolver) callsOf(name string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.calls[name]
+}
+
+func TestDNS(t *testing.T) {
+	container.DNSMinTTL = 10 * time.Millisecond
+
+	short := 10 * time.Millisecond
+
+	resolver := &fakeResolver{
+		calls: make(map[string]int),
+		responses: map[string][]dnsResponse{
+			"web": {
+				{records: []container.DNSRecord{{Host: "10.0.0.1", Port: 8000, TTL: short}}},
+				// failures keep the previous records
+				{err: errors.New("server misbehaving")},
+				{records: []container.DNSRecord{{Host: "10.0.0.1", Port: 8000, TTL: short}, {Host: "10.0.0.2", Port: 8000, TTL: short}}},
+				{records: []container.DNSRecord{{Host: "10.0.0.2", Port: 8000, TTL: short}}},
+			},
+			"_http._tcp.api.example.com": {
+				{records: []container.DNSRecord{{Host: "api-1.example.com", Port: 9000, TTL: time.Hour}}},
+			},
+		},
+	}
+
+	targets, err := container.ParseDNSTargets("web:8000, _http._tcp.api.example.com", "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dns := container.NewDNS(resolver, targets)
+	consumer := pipe(t, dns)
+
+	api := consumer.expect("_http._tcp.api.example.com/api-1.example.com:9000", true)
+	if api.PingAddr.String() != "http://api-1.example.com:9000/config" {
+		t.Fatalf("unexpected container %+v", api)
+	}
+
+	consumer.expect("web/10.0.0.1:8000", true)
+	consumer.expect("web/10.0.0.2:8000", true)
+	consumer.expect("web/10.0.0.1:8000", false)
+
+	dns.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// SRV record's TTL has not been passed yet
+	if calls := resolver.callsOf("_http._tcp.api.example.com"); calls != 1 {
+		t.Fatalf("expected SRV record to be resolved once but resolved %d times", calls)
+	}
+}
+
+func TestParseDNSTargets(t *testing.T) {
+	_, err := container.ParseDNSTargets("web", "")
+	if err == nil {
+		t.Fatal("expected error for A record without port")
+	}
+}
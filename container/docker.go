@@ -6,23 +6,66 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/pkg/endpoint"
 	"github.com/alinz/baker/pkg/logger"
 )
 
+// Labels which are read from containers
+const (
+	// LabelServicePrefix is the prefix of all labels of an endpoint. Named endpoints
+	// use baker.service.<name>. as their prefix, e.g. baker.service.admin.port
+	LabelServicePrefix = "baker.service."
+
+	LabelNetwork     = "baker.network"
+	LabelServicePort = "baker.service.port"
+	LabelServicePing = "baker.service.ping"
+	LabelServiceSSL  = "baker.service.ssl"
+
+	// LabelDockerHealth can be set to false, so Docker's HEALTHCHECK status is ignored
+	LabelDockerHealth = "baker.service.docker_health"
+
+	LabelTLSCA         = "baker.service.tls.ca"
+	LabelTLSServerName = "baker.service.tls.server_name"
+	LabelTLSCert       = "baker.service.tls.cert"
+	LabelTLSKey        = "baker.service.tls.key"
+)
+
 type event struct {
 	id     string
 	active bool
 }
 
+// Delays between reconnecting to Docker's events stream. Delay starts from
+// ReconnectMinDelay and doubles on each failed attempt up to ReconnectMaxDelay
+var (
+	ReconnectMinDelay = 1 * time.Second
+	ReconnectMaxDelay = 30 * time.Second
+)
+
 // Docker is an implementation of Docker's container producer
 type Docker struct {
 	client *http.Client
 	addr   endpoint.HTTPAddr
 	err    error
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// since is the time of the last received event, it is used
+	// to resume events stream once it's reconnected
+	since time.Time
+	// active holds ids of containers which have been reported as active
+	// NOTE: it's only accessed by the goroutine which pushes events
+	active map[string]struct{}
+	// published holds ids of endpoints which have been pushed for each container
+	// NOTE: it's only accessed by the goroutine which pushes containers
+	published map[string][]string
 }
 
 var _ Producer = (*Docker)(nil)
@@ -39,11 +82,16 @@ func (d *Docker) Pipe(consumer Consumer) {
 	// pushed into containers
 	go d.eventsToContainers(events, containers)
 
+	// events which happen while running containers are being processed
+	// are picked up by events stream
+	d.since = time.Now()
+
 	// Need to process already running containers
 	// need to wait until all already running containers
 	// being transformed into events
-	d.processRunningContainers(events)
+	d.err = d.processRunningContainers(events)
 	if d.err != nil {
+		close(events)
 		consumer.Close(d.err)
 		return
 	}
@@ -60,16 +108,36 @@ func (d *Docker) Pipe(consumer Consumer) {
 	consumer.Close(nil)
 }
 
+// Stop terminates events stream, Pipe returns once all pending containers are consumed
+func (d *Docker) Stop() {
+	d.cancel()
+}
+
+// push sends an event and keeps track of active containers
+func (d *Docker) push(events chan<- *event, id string, active bool) {
+	if active {
+		d.active[id] = struct{}{}
+	} else {
+		delete(d.active, id)
+	}
+
+	events <- &event{
+		id:     id,
+		active: active,
+	}
+}
+
 // processRunningContainers will be called at first to make sure running containers
-// also get updated. This makes sure the already running containers get registered
-func (d *Docker) processRunningContainers(events chan<- *event) {
+// also get updated. This makes sure the already running containers get registered.
+// It is also called after events stream is reconnected, containers which have been
+// reported as active but no longer exist, are reported as inactive
+func (d *Docker) processRunningContainers(events chan<- *event) error {
 	addr := d.addr.WithPath("/containers/json")
-	resp, err := d.client.Get(addr.String())
+	resp, err := d.get(addr.String())
 	if err != nil {
-		d.err = err
-		close(events)
-		return
+		return err
 	}
+	defer resp.Body.Close()
 
 	payload := []struct {
 		ID    string `json:"Id"`
@@ -78,56 +146,188 @@ func (d *Docker) processRunningContainers(events chan<- *event) {
 
 	err = json.NewDecoder(resp.Body).Decode(&payload)
 	if err != nil {
-		d.err = err
-		close(events)
-		return
+		return err
 	}
 
+	existing := make(map[string]struct{}, len(payload))
 	for _, data := range payload {
-		events <- &event{
-			id:     data.ID,
-			active: data.State == "running",
+		existing[data.ID] = struct{}{}
+		d.push(events, data.ID, data.State == "running")
+	}
+
+	for id := range d.active {
+		if _, ok := existing[id]; !ok {
+			d.push(events, id, false)
 		}
 	}
+
+	return nil
 }
 
-// processLiveEvents process all incoming events, in case of any error,
-// error value will be set to internal err property and events' channel will
-// be closed.
-// NOTE: This method is blocking and will terminate if an error occurs
+// processLiveEvents process all incoming events. Once events stream is interrupted,
+// it reconnects with exponential backoff, resumes the stream from the last received event
+// and resyncs running containers to catch up with the missed events.
+// NOTE: This method is blocking and closes events' channel once Docker is stopped
 func (d *Docker) processLiveEvents(events chan<- *event) {
+	defer close(events)
+
+	delay := ReconnectMinDelay
+
+	for {
+		connected, err := d.streamEvents(events)
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			delay = ReconnectMinDelay
+		}
+
+		logger.Warn("docker events stream is interrupted because %s, reconnecting in %s", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			return
+		}
+
+		delay *= 2
+		if delay > ReconnectMaxDelay {
+			delay = ReconnectMaxDelay
+		}
+
+		err = d.processRunningContainers(events)
+		if err != nil {
+			logger.Error("failed to resync running containers because %s", err)
+		}
+	}
+}
+
+// streamEvents reads events stream since the last received event until an error occurs.
+// connected is true if the stream has been established
+func (d *Docker) streamEvents(events chan<- *event) (connected bool, err error) {
+	query := url.Values{}
+	query.Set("since", fmt.Sprintf("%d.%09d", d.since.Unix(), d.since.Nanosecond()))
+
 	addr := d.addr.WithPath("/events")
-	resp, err := d.client.Get(addr.String())
+	resp, err := d.get(addr.String() + "?" + query.Encode())
 	if err != nil {
-		d.err = err
-		close(events)
-		return
+		return false, err
 	}
+	defer resp.Body.Close()
 
 	eventsDecoder := json.NewDecoder(resp.Body)
 
 	for {
-		payload := struct {
-			ID     string `json:"id"`
-			Status string `json:"status"`
-		}{}
+		payload := &dockerEvent{}
 
-		err = eventsDecoder.Decode(&payload)
+		err = eventsDecoder.Decode(payload)
 		if err != nil {
-			d.err = err
-			close(events)
-			return
+			return true, err
 		}
 
-		if payload.Status != "die" && payload.Status != "start" {
+		if payload.TimeNano > 0 {
+			d.since = time.Unix(0, payload.TimeNano)
+		}
+
+		id, active, ok := payload.parse()
+		if !ok {
 			continue
 		}
 
-		events <- &event{
-			id:     payload.ID,
-			active: payload.Status == "start",
+		logger.Debug("docker event %s %s for container %s", payload.Type, payload.Action, id)
+		d.push(events, id, active)
+	}
+}
+
+// dockerEvent is a single message of Docker's events stream
+type dockerEvent struct {
+	// ID and Status are kept for older versions of Docker's api
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Type     string `json:"Type"`
+	Action   string `json:"Action"`
+	TimeNano int64  `json:"timeNano"`
+	Actor    struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// signals which terminate a container, any other signal sent by kill,
+// such as SIGHUP, doesn't stop the container
+var stopSignals = map[string]bool{
+	"":        true,
+	"2":       true,
+	"9":       true,
+	"15":      true,
+	"SIGINT":  true,
+	"SIGKILL": true,
+	"SIGTERM": true,
+}
+
+// parse returns the container which event belongs to. If active is true, container
+// needs to be inspected again since it might be able to receive traffic, otherwise
+// container must stop receiving traffic. ok is false if event should be ignored
+func (e *dockerEvent) parse() (id string, active bool, ok bool) {
+	typ, action, id := e.Type, e.Action, e.Actor.ID
+	if typ == "" {
+		typ = "container"
+	}
+	if action == "" {
+		action = e.Status
+	}
+	if id == "" {
+		id = e.ID
+	}
+
+	switch typ {
+	case "container":
+		// health_status's action also contains the status, e.g. 'health_status: healthy'
+		if strings.HasPrefix(action, "health_status") {
+			return id, true, true
+		}
+
+		switch action {
+		case "start", "unpause", "rename":
+			return id, true, true
+		case "die", "stop", "destroy", "pause":
+			return id, false, true
+		case "kill":
+			return id, false, stopSignals[e.Actor.Attributes["signal"]]
 		}
+
+	case "network":
+		// container might join or leave baker's network, container needs to be
+		// inspected to find out its address in baker's network
+		switch action {
+		case "connect", "disconnect":
+			container := e.Actor.Attributes["container"]
+			return container, true, container != ""
+		}
+	}
+
+	return "", false, false
+}
+
+// get sends a GET request which is canceled once Docker is stopped
+func (d *Docker) get(addr string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker responded with status %d", resp.StatusCode)
+	}
+
+	return resp, nil
 }
 
 // eventsToContainers processes all the events and tries to push containers objects to containers channel.
@@ -141,87 +341,258 @@ func (d *Docker) eventsToContainers(events <-chan *event, containers chan<- *bak
 		// exists and there is no need to fetch its data
 		if !event.active {
 			logger.Debug("container %s is not active", event.id)
-			containers <- &baker.Container{
-				ID: event.id,
-			}
+			d.remove(containers, event.id, nil)
 			continue
 		}
 
 		logger.Debug("container %s is active", event.id)
 
-		addr := d.addr.WithPath("/containers/" + event.id + "/json")
-		resp, err := d.client.Get(addr.String())
+		endpoints, err := d.inspect(event.id)
 		if err != nil {
-			logger.Error("fetch container '%s' info because %s", event.id, err)
-
-			containers <- &baker.Container{
-				ID:  event.id,
-				Err: err,
-			}
+			d.remove(containers, event.id, err)
 			continue
 		}
 
-		payload := &struct {
-			ID string `json:"Id"`
+		d.publish(containers, event.id, endpoints)
+	}
+}
 
-			Config *struct {
-				Labels *struct {
-					Network     string `json:"baker.network"`
-					ServicePort string `json:"baker.service.port"`
-					ServicePing string `json:"baker.service.ping"`
-					ServiceSSL  string `json:"baker.service.ssl"`
-				} `json:"Labels"`
-			} `json:"Config"`
+// inspect fetches container's info and returns a container object for each of its endpoints.
+// An empty list is returned if container is not ready to receive traffic
+func (d *Docker) inspect(id string) ([]*baker.Container, error) {
+	addr := d.addr.WithPath("/containers/" + id + "/json")
+	resp, err := d.get(addr.String())
+	if err != nil {
+		logger.Error("fetch container '%s' info because %s", id, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &struct {
+		ID string `json:"Id"`
+
+		State struct {
+			Running bool `json:"Running"`
+			Paused  bool `json:"Paused"`
+			Health  *struct {
+				Status string `json:"Status"`
+			} `json:"Health"`
+		} `json:"State"`
+
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}{}
 
-			NetworkSettings struct {
-				Networks map[string]struct {
-					IPAddress string `json:"IPAddress"`
-				} `json:"Networks"`
-			} `json:"NetworkSettings"`
-		}{}
+	err = json.NewDecoder(resp.Body).Decode(payload)
+	if err != nil {
+		logger.Error("failed to parse container %s", id)
+		return nil, err
+	}
 
-		err = json.NewDecoder(resp.Body).Decode(payload)
-		if err != nil {
-			logger.Error("failed to parse container %s", event.id)
+	// container might have been stopped or paused before it's inspected
+	if !payload.State.Running || payload.State.Paused {
+		logger.Debug("container %s is not running", id)
+		return nil, nil
+	}
+
+	labels := payload.Config.Labels
 
+	// if image defines a HEALTHCHECK, container only receives traffic once it's healthy
+	health := payload.State.Health
+	if health != nil && health.Status != "" && health.Status != "none" && health.Status != "healthy" && labels[LabelDockerHealth] != "false" {
+		logger.Debug("container %s is %s", id, health.Status)
+		return nil, nil
+	}
+
+	network, ok := payload.NetworkSettings.Networks[labels[LabelNetwork]]
+	if !ok {
+		logger.Debug("network %s not exisits in label for container %s", labels[LabelNetwork], id)
+		return nil, fmt.Errorf("network '%s' not exists in labels", labels[LabelNetwork])
+	}
+
+	endpoints := make([]*baker.Container, 0, 1)
+	for endpointID, endpointLabels := range endpointsLabels(id, labels) {
+		endpoints = append(endpoints, containerFromLabels(endpointID, network.IPAddress, endpointLabels))
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].ID < endpoints[j].ID
+	})
+
+	return endpoints, nil
+}
+
+// publish pushes all endpoints of a container. Endpoints which were pushed
+// previously but no longer exist are pushed as inactive
+func (d *Docker) publish(containers chan<- *baker.Container, id string, endpoints []*baker.Container) {
+	if len(endpoints) == 0 {
+		d.remove(containers, id, nil)
+		return
+	}
+
+	ids := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		ids = append(ids, endpoint.ID)
+	}
+
+	for _, previous := range d.published[id] {
+		if !containsString(ids, previous) {
 			containers <- &baker.Container{
-				ID:  event.id,
-				Err: err,
+				ID: previous,
 			}
-			continue
 		}
+	}
 
-		network, ok := payload.NetworkSettings.Networks[payload.Config.Labels.Network]
-		if !ok {
-			logger.Debug("network %s not exisits in label for container %s", payload.Config.Labels.Network, event.id)
+	for _, endpoint := range endpoints {
+		containers <- endpoint
+	}
 
-			containers <- &baker.Container{
-				ID:  event.id,
-				Err: fmt.Errorf("network '%s' not exists in labels", payload.Config.Labels.Network),
-			}
+	d.published[id] = ids
+}
+
+// remove pushes all previously pushed endpoints of a container as inactive
+func (d *Docker) remove(containers chan<- *baker.Container, id string, err error) {
+	ids, ok := d.published[id]
+	if !ok {
+		ids = []string{id}
+	}
+
+	for _, id := range ids {
+		containers <- &baker.Container{
+			ID:  id,
+			Err: err,
+		}
+	}
+
+	delete(d.published, id)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endpointsLabels returns labels of each endpoint of a container by endpoint's id.
+// Each named endpoint, defined by baker.service.<name>.port label, gets <id>/<name> as id
+// and its labels, baker.service.<name>.*, override container's labels. Container's id
+// is used for the default endpoint, defined by baker.service.port label
+func endpointsLabels(id string, labels map[string]string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+
+	for key := range labels {
+		rest := strings.TrimPrefix(key, LabelServicePrefix)
+		if rest == key || !strings.HasSuffix(rest, ".port") {
 			continue
 		}
 
-		port, err := strconv.ParseInt(payload.Config.Labels.ServicePort, 10, 32)
-		if err != nil {
-			logger.Debug("failed to parse port for container '%s' because %s", event.id, err)
+		name := strings.TrimSuffix(rest, ".port")
+		if name == "" || strings.Contains(name, ".") {
+			continue
+		}
 
-			containers <- &baker.Container{
-				ID:  event.id,
-				Err: fmt.Errorf("failed to parse port for container '%s' because %s", event.id, err),
-			}
+		result[id+"/"+name] = overlayLabels(labels, name)
+	}
+
+	if _, ok := labels[LabelServicePort]; ok || len(result) == 0 {
+		result[id] = labels
+	}
+
+	return result
+}
+
+// overlayLabels returns a copy of labels where baker.service.<name>.port, ping, ssl, docker_health
+// and tls.* replace baker.service.* ones and any other baker.service.<name>.* replaces baker.*
+func overlayLabels(labels map[string]string, name string) map[string]string {
+	prefix := LabelServicePrefix + name + "."
+	result := make(map[string]string, len(labels))
+
+	for key, value := range labels {
+		result[key] = value
+	}
+
+	for key, value := range labels {
+		if !strings.HasPrefix(key, prefix) {
 			continue
 		}
 
-		serviceAddr := endpoint.NewAddr(network.IPAddress, int(port), payload.Config.Labels.ServiceSSL == "true")
+		rest := strings.TrimPrefix(key, prefix)
+		switch {
+		case rest == "port", rest == "ping", rest == "ssl", rest == "docker_health", strings.HasPrefix(rest, "tls."):
+			result[LabelServicePrefix+rest] = value
+		default:
+			result["baker."+rest] = value
+		}
+	}
 
-		containers <- &baker.Container{
-			ID:       event.id,
-			Active:   true,
-			Addr:     serviceAddr,
-			PingAddr: endpoint.NewHTTPAddr(serviceAddr, payload.Config.Labels.ServicePing),
+	return result
+}
+
+// containerFromLabels creates container object of an endpoint
+func containerFromLabels(id string, ip string, labels map[string]string) *baker.Container {
+	port, err := strconv.ParseInt(labels[LabelServicePort], 10, 32)
+	if err != nil {
+		logger.Debug("failed to parse port for container '%s' because %s", id, err)
+
+		return &baker.Container{
+			ID:  id,
+			Err: fmt.Errorf("failed to parse port for container '%s' because %s", id, err),
+		}
+	}
+
+	serviceAddr := endpoint.NewAddr(ip, int(port), labels[LabelServiceSSL] == "true")
+
+	return &baker.Container{
+		ID:       id,
+		Active:   true,
+		Addr:     serviceAddr,
+		PingAddr: endpoint.NewHTTPAddr(serviceAddr, labels[LabelServicePing]),
+		TLS:      tlsFromLabels(labels),
+		Labels:   labels,
+	}
+}
+
+// tlsFromLabels returns tls settings only if at least one of the tls labels is presented
+func tlsFromLabels(labels map[string]string) *baker.TLS {
+	if labels[LabelTLSCA] == "" && labels[LabelTLSServerName] == "" && labels[LabelTLSCert] == "" &&
+		labels[LabelTLSKey] == "" {
+		return nil
+	}
+
+	return &baker.TLS{
+		CA:         labels[LabelTLSCA],
+		ServerName: labels[LabelTLSServerName],
+		Cert:       labels[LabelTLSCert],
+		Key:        labels[LabelTLSKey],
+	}
+}
+
+// isTLSFileLabel reports whether key is baker.service.tls.ca, cert or key, or one of their
+// named endpoint forms. They are files on baker's side, so only operator can set them
+func isTLSFileLabel(key string) bool {
+	rest := strings.TrimPrefix(key, LabelServicePrefix)
+	if rest == key {
+		return false
+	}
+
+	for _, file := range []string{"tls.ca", "tls.cert", "tls.key"} {
+		if rest == file || strings.HasSuffix(rest, "."+file) {
+			return true
 		}
 	}
+
+	return false
 }
 
 // DefaultClient is a default client which uses unix protocol
@@ -238,8 +609,14 @@ const DefaultAddr = "http://localhost"
 
 // NewDocker creates a new docker watcher
 func NewDocker(client *http.Client, addr string) *Docker {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Docker{
-		client: client,
-		addr:   endpoint.ParseHTTPAddr(addr),
+		client:    client,
+		addr:      endpoint.ParseHTTPAddr(addr),
+		ctx:       ctx,
+		cancel:    cancel,
+		active:    make(map[string]struct{}),
+		published: make(map[string][]string),
 	}
 }
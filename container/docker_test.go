@@ -7,14 +7,23 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/container"
 )
 
-func mockResponse(t *testing.T, scenario string, r *http.Request) io.ReadCloser {
-	file, err := os.Open(path.Join("./fixtures/docker/api", scenario, r.URL.String(), "payload.json"))
+// mockResponse returns fixture of given path. If path is requested multiple times,
+// payload.<n>.json is used for n-th request if it exists
+func mockResponse(t *testing.T, dir string, urlPath string, n int) io.ReadCloser {
+	file, err := os.Open(path.Join(dir, urlPath, fmt.Sprintf("payload.%d.json", n)))
+	if err == nil {
+		return file
+	}
+
+	file, err = os.Open(path.Join(dir, urlPath, "payload.json"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,9 +31,18 @@ func mockResponse(t *testing.T, scenario string, r *http.Request) io.ReadCloser
 	return file
 }
 
-func mockDockerServer(t *testing.T, scenario string) *httptest.Server {
+// mockServer serves fixtures under dir based on request's path
+func mockServer(t *testing.T, dir string) *httptest.Server {
+	var mux sync.Mutex
+	calls := make(map[string]int)
+
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		resp := mockResponse(t, scenario, r)
+		mux.Lock()
+		calls[r.URL.Path]++
+		n := calls[r.URL.Path]
+		mux.Unlock()
+
+		resp := mockResponse(t, dir, r.URL.Path, n)
 		defer resp.Close()
 
 		w.WriteHeader(http.StatusOK)
@@ -34,22 +52,12 @@ func mockDockerServer(t *testing.T, scenario string) *httptest.Server {
 	return server
 }
 
-type DummyConsumer struct {
-	container func(container *baker.Container) error
-	close     func(err error)
-}
-
-var _ (container.Consumer) = (*DummyConsumer)(nil)
-
-func (dc *DummyConsumer) Container(container *baker.Container) error {
-	return dc.container(container)
-}
-
-func (dc *DummyConsumer) Close(err error) {
-	dc.close(err)
+func mockDockerServer(t *testing.T, scenario string) *httptest.Server {
+	return mockServer(t, path.Join("./fixtures/docker/api", scenario))
 }
 
 func TestDocker(t *testing.T) {
+	container.ReconnectMinDelay = 10 * time.Millisecond
 
 	testCases := []struct {
 		scenario string
@@ -64,14 +72,235 @@ func TestDocker(t *testing.T) {
 		defer server.Close()
 
 		docker := container.NewDocker(server.Client(), server.URL)
-		docker.Pipe(&DummyConsumer{
-			container: func(container *baker.Container) error {
-				fmt.Println(container)
-				return nil
-			},
-			close: func(err error) {
-				fmt.Println(err)
-			},
+		consumer := pipe(t, docker)
+
+		consumer.expect("service-1", true)
+
+		docker.Stop()
+
+		go func() {
+			for range consumer.received {
+			}
+		}()
+
+		select {
+		case err := <-consumer.closed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pipe is not closed after stop")
+		}
+	}
+}
+
+func TestDockerReconnect(t *testing.T) {
+	container.ReconnectMinDelay = 10 * time.Millisecond
+
+	var mux sync.Mutex
+	listCalls := 0
+	eventsCalls := 0
+	since := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		switch r.URL.Path {
+		case "/containers/json":
+			listCalls++
+			// service-2 is removed while events stream is disconnected
+			if listCalls == 1 {
+				fmt.Fprint(w, `[{"Id":"service-1","State":"running"},{"Id":"service-2","State":"running"}]`)
+			} else {
+				fmt.Fprint(w, `[{"Id":"service-1","State":"running"}]`)
+			}
+
+		case "/events":
+			eventsCalls++
+			if eventsCalls == 1 {
+				// stream ends right after an event, same as Docker daemon restarts
+				fmt.Fprint(w, `{"status":"start","id":"service-1","timeNano":1572628542974015300}`)
+				return
+			}
+
+			since <- r.URL.Query().Get("since")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			mux.Unlock()
+			<-r.Context().Done()
+			mux.Lock()
+
+		default:
+			resp := mockResponse(t, "./fixtures/docker/api/scenario1", "/containers/service-1/json", 1)
+			defer resp.Close()
+			io.Copy(w, resp)
+		}
+	}))
+	defer server.Close()
+
+	var removed sync.Once
+	removedCh := make(chan struct{})
+	closed := make(chan error, 1)
+
+	docker := container.NewDocker(server.Client(), server.URL)
+	go docker.Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			if container.ID == "service-2" && !container.Active {
+				removed.Do(func() { close(removedCh) })
+			}
+			return nil
+		},
+		close: func(err error) {
+			closed <- err
+		},
+	})
+
+	select {
+	case value := <-since:
+		if value != "1572628542.974015300" {
+			t.Fatalf("expected stream to resume since last event but got %s", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("events stream is not reconnected")
+	}
+
+	select {
+	case <-removedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed container is not reported after resync")
+	}
+
+	docker.Stop()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe is not closed after stop")
+	}
+}
+
+func TestDockerEvents(t *testing.T) {
+	container.ReconnectMinDelay = time.Minute
+
+	type update struct {
+		active bool
+		err    bool
+	}
+
+	running := update{active: true}
+	stopped := update{}
+	failed := update{err: true}
+
+	testCases := []struct {
+		scenario string
+		expected []update
+	}{
+		{
+			scenario: "events_pause",
+			expected: []update{running, stopped},
+		},
+		{
+			scenario: "events_unpause",
+			expected: []update{stopped, running},
+		},
+		{
+			scenario: "events_stop",
+			expected: []update{running, stopped, stopped, stopped},
+		},
+		{
+			// kill with SIGHUP is ignored
+			scenario: "events_kill",
+			expected: []update{running, stopped},
+		},
+		{
+			scenario: "events_destroy",
+			expected: []update{running, stopped},
+		},
+		{
+			scenario: "events_rename",
+			expected: []update{running, running},
+		},
+		{
+			scenario: "events_health_status",
+			expected: []update{running, running},
+		},
+		{
+			// container becomes healthy and then unhealthy
+			scenario: "docker_health",
+			expected: []update{stopped, running, stopped},
+		},
+		{
+			scenario: "docker_health_opt_out",
+			expected: []update{running, running},
+		},
+		{
+			scenario: "events_network_connect",
+			expected: []update{failed, running},
+		},
+		{
+			scenario: "events_network_disconnect",
+			expected: []update{running, failed},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.scenario, func(t *testing.T) {
+			server := mockDockerServer(t, testCase.scenario)
+			defer server.Close()
+
+			docker := container.NewDocker(server.Client(), server.URL)
+			consumer := pipe(t, docker)
+
+			for i, expected := range testCase.expected {
+				c := consumer.next()
+				if c.ID != "service-1" || c.Active != expected.active || (c.Err != nil) != expected.err {
+					t.Fatalf("expected update %d to be %+v but got %+v", i, expected, c)
+				}
+			}
+
+			docker.Stop()
+			<-consumer.closed
+
+			if len(consumer.received) != 0 {
+				t.Fatalf("expected no more updates but got %d", len(consumer.received))
+			}
 		})
 	}
 }
+
+func TestDockerEndpoints(t *testing.T) {
+	container.ReconnectMinDelay = time.Minute
+
+	server := mockDockerServer(t, "endpoints")
+	defer server.Close()
+
+	docker := container.NewDocker(server.Client(), server.URL)
+	consumer := pipe(t, docker)
+	defer func() {
+		docker.Stop()
+		<-consumer.closed
+	}()
+
+	admin := consumer.next()
+	if admin.ID != "service-1/admin" || !admin.Active || admin.Addr.Port() != 9000 || admin.Labels["baker.domain"] != "admin.example.com" {
+		t.Fatalf("unexpected admin endpoint %+v", admin)
+	}
+
+	api := consumer.next()
+	if api.ID != "service-1/api" || !api.Active || api.Addr.Port() != 8000 || api.PingAddr.Path() != "/config" || api.Labels["baker.domain"] != "api.example.com" {
+		t.Fatalf("unexpected api endpoint %+v", api)
+	}
+
+	// once container dies, all of its endpoints are removed
+	for _, id := range []string{"service-1/admin", "service-1/api"} {
+		c := consumer.next()
+		if c.ID != id || c.Active {
+			t.Fatalf("expected %s to be removed but got %+v", id, c)
+		}
+	}
+}
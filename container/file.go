@@ -0,0 +1,147 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/interval"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// FileUpstream is a single upstream which is described in File's json file
+type FileUpstream struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	SSL  bool   `json:"ssl"`
+	// Ping is the path of config endpoint, it's not required if Config is set
+	Ping   string        `json:"ping"`
+	Config *baker.Config `json:"config"`
+	// TLS is used to connect to a secure upstream, it's only accepted from the upstreams file
+	TLS *baker.TLS `json:"tls"`
+}
+
+// File is an implementation of container producer which reads upstreams from a json file.
+// File is polled and once its modification time changes, the differences are pushed
+type File struct {
+	path         string
+	pollInterval time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+	consumer     Consumer
+	modTime      time.Time
+	snapshot     *snapshot
+}
+
+var _ Producer = (*File)(nil)
+var _ interval.Ticker = (*File)(nil)
+
+// Pipe reads the file and pushes its upstreams and keeps watching the file for changes
+// NOTE: this method is blocking call
+func (f *File) Pipe(consumer Consumer) {
+	f.consumer = consumer
+
+	err := f.sync()
+	if err != nil {
+		consumer.Close(err)
+		return
+	}
+
+	interval.Run(f.ctx, f, f.pollInterval)
+
+	consumer.Close(nil)
+}
+
+// Stop terminates watching the file
+func (f *File) Stop() {
+	f.cancel()
+}
+
+// Tick checks whether file has been changed. If file can't be read or parsed, error is
+// logged and previous upstreams are kept
+// NOTE: do not call this method, this will be called by interval.Run package.
+func (f *File) Tick(ctx context.Context) error {
+	err := f.sync()
+	if err != nil {
+		logger.Error("failed to read upstreams from %s because %s", f.path, err)
+	}
+
+	return nil
+}
+
+// sync reads the file if it has been modified since the last read
+func (f *File) sync() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	upstreams := []*FileUpstream{}
+
+	err = json.NewDecoder(file).Decode(&upstreams)
+	if err != nil {
+		return fmt.Errorf("failed to parse file because %s", err)
+	}
+
+	f.modTime = info.ModTime()
+
+	containers := make([]*baker.Container, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		containers = append(containers, upstream.container())
+	}
+
+	for _, container := range f.snapshot.update(containers) {
+		f.consumer.Container(container)
+	}
+
+	return nil
+}
+
+func (u *FileUpstream) container() *baker.Container {
+	if u.Host == "" || u.Port <= 0 {
+		return &baker.Container{
+			ID:  u.ID,
+			Err: fmt.Errorf("upstream '%s' requires host and port", u.ID),
+		}
+	}
+
+	addr := endpoint.NewAddr(u.Host, u.Port, u.SSL)
+
+	return &baker.Container{
+		ID:       u.ID,
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, u.Ping),
+		TLS:      u.TLS,
+		Config:   u.Config,
+	}
+}
+
+// NewFile creates a producer which reads upstreams from a json file at path
+// and checks it for changes on every pollInterval
+func NewFile(path string, pollInterval time.Duration) *File {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &File{
+		path:         path,
+		pollInterval: pollInterval,
+		ctx:          ctx,
+		cancel:       cancel,
+		snapshot:     newSnapshot(),
+	}
+}
@@ -0,0 +1,97 @@
+package container_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+)
+
+func writeUpstreams(t *testing.T, filename string, content string, modTime time.Time) {
+	err := ioutil.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// makes sure modification time changes even if file is written within the same tick
+	err = os.Chtimes(filename, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baker-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "upstreams.json")
+	now := time.Now()
+
+	writeUpstreams(t, filename, `[
+		{"id": "api-1", "host": "10.0.0.1", "port": 8000, "ping": "/config"},
+		{"id": "api-2", "host": "10.0.0.2", "port": 8000, "config": {"domain": "example.com", "path": "/*", "ready": true}}
+	]`, now)
+
+	file := container.NewFile(filename, 10*time.Millisecond)
+	consumer := pipe(t, file)
+
+	api1 := consumer.next()
+	if api1.ID != "api-1" || !api1.Active || api1.PingAddr.String() != "http://10.0.0.1:8000/config" || api1.Config != nil {
+		t.Fatalf("unexpected container %+v", api1)
+	}
+
+	api2 := consumer.next()
+	if api2.ID != "api-2" || !api2.Active || api2.Config == nil || api2.Config.Domain != "example.com" {
+		t.Fatalf("unexpected container %+v", api2)
+	}
+
+	// invalid file keeps the previous upstreams
+	writeUpstreams(t, filename, `[{"id": `, now.Add(time.Second))
+
+	// api-1 is removed, api-2 is unchanged and api-3 is added
+	writeUpstreams(t, filename, `[
+		{"id": "api-2", "host": "10.0.0.2", "port": 8000, "config": {"domain": "example.com", "path": "/*", "ready": true}},
+		{"id": "api-3", "host": "10.0.0.3", "port": 8000, "ssl": true, "tls": {"ca": "/certs/ca.pem"}}
+	]`, now.Add(2*time.Second))
+
+	removed := consumer.next()
+	if removed.ID != "api-1" || removed.Active {
+		t.Fatalf("expected api-1 to be removed but got %+v", removed)
+	}
+
+	added := consumer.next()
+	if added.ID != "api-3" || !added.Active || !added.Addr.Secure() || added.TLS == nil || added.TLS.CA != "/certs/ca.pem" {
+		t.Fatalf("expected api-3 to be added but got %+v", added)
+	}
+
+	file.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(consumer.received) != 0 {
+		t.Fatalf("expected no more updates but got %d", len(consumer.received))
+	}
+}
+
+func TestFileNotExists(t *testing.T) {
+	closed := make(chan error, 1)
+
+	file := container.NewFile("./does-not-exist.json", time.Second)
+	file.Pipe(&DummyConsumer{
+		close: func(err error) {
+			closed <- err
+		},
+	})
+
+	if err := <-closed; err == nil {
+		t.Fatal("expected an error for missing file")
+	}
+}
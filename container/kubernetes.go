@@ -0,0 +1,543 @@
+package container
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Kubernetes is an implementation of container producer which watches Services and EndpointSlices
+// through Kubernetes' rest api. Services' annotations which start with baker. are used as labels and each
+// ready address of EndpointSlices which belong to those services is produced as a container.
+// baker.service.port annotation can be either a port number or name of a port, if it's not set
+// the first port of EndpointSlice is used
+type Kubernetes struct {
+	client    *http.Client
+	addr      endpoint.HTTPAddr
+	namespace string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	consumer  Consumer
+
+	mux      sync.Mutex
+	services map[string]*k8sService
+	slices   map[string]*k8sEndpointSlice
+	snapshot *snapshot
+}
+
+var _ Producer = (*Kubernetes)(nil)
+
+// errGone is returned once resourceVersion is too old and resources need to be listed again
+var errGone = errors.New("resource version is too old")
+
+// k8sResource describes how a kind of resource is listed and watched
+type k8sResource struct {
+	path string
+	// replace replaces all resources of this kind after a list
+	replace func(items []json.RawMessage) error
+	// apply applies a single watch event
+	apply func(typ string, object json.RawMessage) error
+}
+
+// Pipe lists Services and EndpointSlices and keeps watching them for changes
+// NOTE: this method is blocking call
+func (k *Kubernetes) Pipe(consumer Consumer) {
+	k.consumer = consumer
+
+	resources := []*k8sResource{
+		{path: k.path("/api/v1", "services"), replace: k.replaceServices, apply: k.applyService},
+		{path: k.path("/apis/discovery.k8s.io/v1", "endpointslices"), replace: k.replaceSlices, apply: k.applySlice},
+	}
+
+	// both kinds need to be listed before containers can be produced
+	versions := make([]string, len(resources))
+	for i, resource := range resources {
+		version, err := k.list(resource)
+		if err != nil {
+			consumer.Close(err)
+			return
+		}
+
+		versions[i] = version
+	}
+
+	var wg sync.WaitGroup
+	for i, resource := range resources {
+		wg.Add(1)
+		go func(resource *k8sResource, version string) {
+			defer wg.Done()
+			k.watch(resource, version)
+		}(resource, versions[i])
+	}
+
+	wg.Wait()
+
+	consumer.Close(nil)
+}
+
+// Stop terminates watching Kubernetes
+func (k *Kubernetes) Stop() {
+	k.cancel()
+}
+
+func (k *Kubernetes) path(group string, kind string) string {
+	if k.namespace == "" {
+		return group + "/" + kind
+	}
+
+	return group + "/namespaces/" + url.PathEscape(k.namespace) + "/" + kind
+}
+
+// watch watches a resource from given version. Once watch is interrupted, it resumes from the last seen
+// version and if that version is too old, resources are listed again
+func (k *Kubernetes) watch(resource *k8sResource, version string) {
+	delay := ReconnectMinDelay
+
+	for {
+		var err error
+
+		if version == "" {
+			version, err = k.list(resource)
+		}
+
+		if err == nil {
+			err = k.stream(resource, &version)
+		}
+
+		if k.ctx.Err() != nil {
+			return
+		}
+
+		switch err {
+		case errGone:
+			logger.Debug("resource version of %s is too old, listing again", resource.path)
+			version = ""
+		case io.EOF:
+			// api server closes watches periodically
+			delay = ReconnectMinDelay
+		default:
+			logger.Warn("failed to watch %s because %s, retrying in %s", resource.path, err, delay)
+
+			select {
+			case <-k.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+			if delay > ReconnectMaxDelay {
+				delay = ReconnectMaxDelay
+			}
+		}
+	}
+}
+
+// list replaces all resources of a kind and returns list's resourceVersion
+func (k *Kubernetes) list(resource *k8sResource) (string, error) {
+	resp, err := k.get(resource.path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	payload := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	if err != nil {
+		return "", err
+	}
+
+	err = resource.replace(payload.Items)
+	if err != nil {
+		return "", err
+	}
+
+	return payload.Metadata.ResourceVersion, nil
+}
+
+// stream applies watch events until stream is interrupted. version is updated
+// on each event, so watch can be resumed from it
+func (k *Kubernetes) stream(resource *k8sResource, version *string) error {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", *version)
+
+	resp, err := k.get(resource.path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		event := struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}{}
+
+		err = decoder.Decode(&event)
+		if err != nil {
+			return err
+		}
+
+		if event.Type == "ERROR" {
+			status := struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{}
+
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return errGone
+			}
+
+			return fmt.Errorf("watch failed with %d %s", status.Code, status.Message)
+		}
+
+		object := struct {
+			Metadata k8sMetadata `json:"metadata"`
+		}{}
+
+		err = json.Unmarshal(event.Object, &object)
+		if err != nil {
+			return err
+		}
+
+		*version = object.Metadata.ResourceVersion
+
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+
+		err = resource.apply(event.Type, event.Object)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type k8sMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+func (m *k8sMetadata) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type k8sService struct {
+	Metadata k8sMetadata `json:"metadata"`
+}
+
+type k8sEndpointSlice struct {
+	Metadata  k8sMetadata `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// service returns the key of service which slice belongs to
+func (s *k8sEndpointSlice) service() string {
+	return s.Metadata.Namespace + "/" + s.Metadata.Labels["kubernetes.io/service-name"]
+}
+
+// resolvePort converts port's name into port's number
+func (s *k8sEndpointSlice) resolvePort(value string) string {
+	if _, err := strconv.Atoi(value); err == nil {
+		return value
+	}
+
+	for _, port := range s.Ports {
+		if value == "" || port.Name == value {
+			return strconv.Itoa(port.Port)
+		}
+	}
+
+	return value
+}
+
+func (k *Kubernetes) replaceServices(items []json.RawMessage) error {
+	services := make(map[string]*k8sService, len(items))
+	for _, item := range items {
+		service := &k8sService{}
+		err := json.Unmarshal(item, service)
+		if err != nil {
+			return err
+		}
+
+		services[service.Metadata.key()] = service
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	k.services = services
+	k.update()
+
+	return nil
+}
+
+func (k *Kubernetes) applyService(typ string, object json.RawMessage) error {
+	service := &k8sService{}
+	err := json.Unmarshal(object, service)
+	if err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if typ == "DELETED" {
+		delete(k.services, service.Metadata.key())
+	} else {
+		k.services[service.Metadata.key()] = service
+	}
+
+	k.update()
+
+	return nil
+}
+
+func (k *Kubernetes) replaceSlices(items []json.RawMessage) error {
+	slices := make(map[string]*k8sEndpointSlice, len(items))
+	for _, item := range items {
+		slice := &k8sEndpointSlice{}
+		err := json.Unmarshal(item, slice)
+		if err != nil {
+			return err
+		}
+
+		slices[slice.Metadata.key()] = slice
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	k.slices = slices
+	k.update()
+
+	return nil
+}
+
+func (k *Kubernetes) applySlice(typ string, object json.RawMessage) error {
+	slice := &k8sEndpointSlice{}
+	err := json.Unmarshal(object, slice)
+	if err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if typ == "DELETED" {
+		delete(k.slices, slice.Metadata.key())
+	} else {
+		k.slices[slice.Metadata.key()] = slice
+	}
+
+	k.update()
+
+	return nil
+}
+
+// update builds containers from current services and slices and pushes the changes
+// NOTE: caller must hold the lock
+func (k *Kubernetes) update() {
+	// services and slices are listed separately, until both are listed nothing is pushed
+	if k.services == nil || k.slices == nil {
+		return
+	}
+
+	containers := make([]*baker.Container, 0)
+
+	for _, slice := range k.slices {
+		service, ok := k.services[slice.service()]
+		if !ok {
+			continue
+		}
+
+		// anyone who can edit a Service can set its annotations,
+		// so they can't point baker to its local tls files
+		labels := make(map[string]string)
+		for key, value := range service.Metadata.Annotations {
+			if !strings.HasPrefix(key, "baker.") {
+				continue
+			}
+
+			if isTLSFileLabel(key) {
+				logger.Debug("annotation %s of service %s is ignored", key, slice.service())
+				continue
+			}
+
+			labels[key] = value
+		}
+
+		// services without baker's annotations are ignored
+		if len(labels) == 0 {
+			continue
+		}
+
+		// ports can be referenced by their names and if no port is
+		// given, the first port is used
+		hasPort := false
+		for key, value := range labels {
+			if key == LabelServicePort || strings.HasPrefix(key, LabelServicePrefix) && strings.HasSuffix(key, ".port") {
+				labels[key] = slice.resolvePort(value)
+				hasPort = true
+			}
+		}
+
+		if !hasPort {
+			labels[LabelServicePort] = slice.resolvePort("")
+		}
+
+		for _, e := range slice.Endpoints {
+			// nil ready condition means endpoint is ready
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+
+			for _, address := range e.Addresses {
+				id := slice.service() + "/" + address
+				for endpointID, endpointLabels := range endpointsLabels(id, labels) {
+					containers = append(containers, containerFromLabels(endpointID, address, endpointLabels))
+				}
+			}
+		}
+	}
+
+	for _, container := range k.snapshot.update(containers) {
+		k.consumer.Container(container)
+	}
+}
+
+// get sends a GET request to api server, 410 status is returned as errGone
+func (k *Kubernetes) get(path string, query url.Values) (*http.Response, error) {
+	addr := k.addr.WithPath(path).String()
+	if len(query) > 0 {
+		addr += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(k.ctx, http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errGone
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %s, api server responded with status %d", path, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// NewKubernetes creates a new Kubernetes watcher. addr is the address of api server and if namespace
+// is empty, all namespaces are watched
+func NewKubernetes(client *http.Client, addr string, namespace string) *Kubernetes {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Kubernetes{
+		client:    client,
+		addr:      endpoint.ParseHTTPAddr(addr),
+		namespace: namespace,
+		ctx:       ctx,
+		cancel:    cancel,
+		snapshot:  newSnapshot(),
+	}
+}
+
+// ServiceAccountPath is where Kubernetes mounts service account's token and ca
+const ServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// tokenTransport adds service account's token to each request. Token is read
+// on each request, since Kubernetes rotates it
+type tokenTransport struct {
+	base      http.RoundTripper
+	tokenFile string
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(t.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	return t.base.RoundTrip(r)
+}
+
+// NewKubernetesInClusterClient creates a client and an address of api server, which
+// can be passed to NewKubernetes, using pod's service account
+func NewKubernetesInClusterClient() (*http.Client, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := ioutil.ReadFile(ServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, "", err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", errors.New("failed to parse service account's ca")
+	}
+
+	client := &http.Client{
+		Transport: &tokenTransport{
+			base: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+			tokenFile: ServiceAccountPath + "/token",
+		},
+	}
+
+	return client, "https://" + net.JoinHostPort(host, port), nil
+}
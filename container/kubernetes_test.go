@@ -0,0 +1,195 @@
+package container_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+)
+
+const (
+	k8sServicesPath = "/api/v1/namespaces/default/services"
+	k8sSlicesPath   = "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices"
+)
+
+// fakeKubernetes serves lists and streams watch events which are sent by test
+type fakeKubernetes struct {
+	mux     sync.Mutex
+	lists   map[string]string
+	events  map[string]chan string
+	watches chan string
+}
+
+func (f *fakeKubernetes) setList(path string, list string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.lists[path] = list
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") != "1" {
+		f.mux.Lock()
+		list := f.lists[r.URL.Path]
+		f.mux.Unlock()
+
+		fmt.Fprint(w, list)
+		return
+	}
+
+	f.watches <- r.URL.Path + "@" + r.URL.Query().Get("resourceVersion")
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case event := <-f.events[r.URL.Path]:
+			// empty event closes the stream
+			if event == "" {
+				return
+			}
+
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func k8sService(version string, annotations string) string {
+	return fmt.Sprintf(`{"metadata":{"name":"web","namespace":"default","resourceVersion":"%s","annotations":%s}}`, version, annotations)
+}
+
+func k8sSlice(version string, endpoints string) string {
+	return fmt.Sprintf(`{"metadata":{"name":"web-abc","namespace":"default","resourceVersion":"%s","labels":{"kubernetes.io/service-name":"web"}},`+
+		`"addressType":"IPv4","endpoints":%s,"ports":[{"name":"metrics","port":9090},{"name":"http","port":8080}]}`, version, endpoints)
+}
+
+func TestKubernetes(t *testing.T) {
+	container.ReconnectMinDelay = 10 * time.Millisecond
+
+	annotations := `{"baker.domain":"example.com","baker.service.port":"http","baker.service.ping":"/config"}`
+
+	fake := &fakeKubernetes{
+		lists: map[string]string{
+			k8sServicesPath: `{"metadata":{"resourceVersion":"10"},"items":[` + k8sService("5", annotations) + `,` +
+				`{"metadata":{"name":"other","namespace":"default","resourceVersion":"6"}}]}`,
+			k8sSlicesPath: `{"metadata":{"resourceVersion":"10"},"items":[` +
+				k8sSlice("7", `[{"addresses":["10.1.0.1"],"conditions":{"ready":true}},{"addresses":["10.1.0.2"],"conditions":{"ready":false}}]`) + `]}`,
+		},
+		events: map[string]chan string{
+			k8sServicesPath: make(chan string),
+			k8sSlicesPath:   make(chan string),
+		},
+		watches: make(chan string, 10),
+	}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	producer := container.NewKubernetes(server.Client(), server.URL, "default")
+	consumer := pipe(t, producer)
+
+	expectWatch := func(expected ...string) {
+		seen := make(map[string]bool)
+		for range expected {
+			select {
+			case watch := <-fake.watches:
+				seen[watch] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected watches %v", expected)
+			}
+		}
+
+		for _, watch := range expected {
+			if !seen[watch] {
+				t.Fatalf("expected watch %s but got %v", watch, seen)
+			}
+		}
+	}
+
+	// only ready addresses of services with baker's annotations are produced
+	web1 := consumer.expect("default/web/10.1.0.1", true)
+	if web1.Addr.String() != "10.1.0.1:8080" || web1.PingAddr.Path() != "/config" || web1.Labels["baker.domain"] != "example.com" {
+		t.Fatalf("unexpected container %+v", web1)
+	}
+
+	expectWatch(k8sServicesPath+"@10", k8sSlicesPath+"@10")
+
+	// second address becomes ready
+	fake.events[k8sSlicesPath] <- `{"type":"MODIFIED","object":` +
+		k8sSlice("11", `[{"addresses":["10.1.0.1"],"conditions":{"ready":true}},{"addresses":["10.1.0.2"],"conditions":{"ready":true}}]`) + `}`
+	consumer.expect("default/web/10.1.0.2", true)
+
+	// bookmark only moves resource version forward
+	fake.events[k8sSlicesPath] <- `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`
+
+	// watch is resumed from the last resource version once it's closed
+	fake.events[k8sSlicesPath] <- ""
+	expectWatch(k8sSlicesPath + "@12")
+
+	// resource version is expired while first address is removed, slices are listed again
+	fake.setList(k8sSlicesPath, `{"metadata":{"resourceVersion":"20"},"items":[`+
+		k8sSlice("19", `[{"addresses":["10.1.0.2"],"conditions":{"ready":true}}]`)+`]}`)
+	fake.events[k8sSlicesPath] <- `{"type":"ERROR","object":{"kind":"Status","status":"Failure","reason":"Expired","code":410}}`
+	consumer.expect("default/web/10.1.0.1", false)
+	expectWatch(k8sSlicesPath + "@20")
+
+	// service is deleted
+	fake.events[k8sServicesPath] <- `{"type":"DELETED","object":` + k8sService("21", annotations) + `}`
+	consumer.expect("default/web/10.1.0.2", false)
+
+	producer.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubernetesTLSFiles(t *testing.T) {
+	// annotations can't point baker to its local files, only server name is kept
+	annotations := `{"baker.domain":"example.com","baker.service.port":"http","baker.service.ping":"/config",` +
+		`"baker.service.tls.ca":"/etc/baker/ca.pem","baker.service.tls.cert":"/etc/baker/cert.pem",` +
+		`"baker.service.tls.key":"/etc/baker/key.pem","baker.service.tls.server_name":"web.internal",` +
+		`"baker.service.admin.tls.key":"/etc/baker/key.pem"}`
+
+	fake := &fakeKubernetes{
+		lists: map[string]string{
+			k8sServicesPath: `{"metadata":{"resourceVersion":"10"},"items":[` + k8sService("5", annotations) + `]}`,
+			k8sSlicesPath: `{"metadata":{"resourceVersion":"10"},"items":[` +
+				k8sSlice("7", `[{"addresses":["10.1.0.1"],"conditions":{"ready":true}}]`) + `]}`,
+		},
+		events: map[string]chan string{
+			k8sServicesPath: make(chan string),
+			k8sSlicesPath:   make(chan string),
+		},
+		watches: make(chan string, 10),
+	}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	producer := container.NewKubernetes(server.Client(), server.URL, "default")
+	consumer := pipe(t, producer)
+	defer func() {
+		producer.Stop()
+		<-consumer.closed
+	}()
+
+	web := consumer.expect("default/web/10.1.0.1", true)
+	if web.TLS == nil || web.TLS.ServerName != "web.internal" || web.TLS.CA != "" || web.TLS.Cert != "" || web.TLS.Key != "" {
+		t.Fatalf("expected only server name to be set but got %+v", web.TLS)
+	}
+
+	for _, key := range []string{"baker.service.tls.ca", "baker.service.tls.cert", "baker.service.tls.key", "baker.service.admin.tls.key"} {
+		if _, ok := web.Labels[key]; ok {
+			t.Fatalf("expected %s to be ignored", key)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Multi merges several producers into one. Containers' ids are prefixed by the name of
+// their producer, e.g. docker:<id>, so ids of different producers never collide
+type Multi struct {
+	producers map[string]Producer
+}
+
+var _ Producer = (*Multi)(nil)
+
+// Pipe starts all producers and pushes their containers into consumer. If a producer fails,
+// its containers are removed and other producers keep running. consumer is closed once all
+// producers are closed, with an error only if all of them have failed
+// NOTE: this method is blocking call
+func (m *Multi) Pipe(consumer Consumer) {
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+
+	errs := make([]string, 0)
+
+	for name, producer := range m.producers {
+		wg.Add(1)
+
+		source := &multiConsumer{
+			name:     name,
+			mux:      &mux,
+			consumer: consumer,
+			active:   make(map[string]struct{}),
+			done: func(name string, err error) {
+				defer wg.Done()
+
+				if err == nil {
+					return
+				}
+
+				mux.Lock()
+				defer mux.Unlock()
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			},
+		}
+
+		go producer.Pipe(source)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 && len(errs) == len(m.producers) {
+		consumer.Close(fmt.Errorf("all producers failed, %s", strings.Join(errs, ", ")))
+		return
+	}
+
+	consumer.Close(nil)
+}
+
+// Stop stops all producers which can be stopped
+func (m *Multi) Stop() {
+	for _, producer := range m.producers {
+		if stopper, ok := producer.(interface{ Stop() }); ok {
+			stopper.Stop()
+		}
+	}
+}
+
+// multiConsumer consumes a single producer and forwards its containers
+// with namespaced ids. mux is shared, so consumer is called by one producer at a time
+type multiConsumer struct {
+	name     string
+	mux      *sync.Mutex
+	consumer Consumer
+	active   map[string]struct{}
+	done     func(name string, err error)
+}
+
+var _ Consumer = (*multiConsumer)(nil)
+
+func (c *multiConsumer) Container(container *baker.Container) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// producers might keep a reference to container, so a copy is pushed
+	namespaced := *container
+	namespaced.ID = c.name + ":" + container.ID
+
+	if namespaced.Active {
+		c.active[namespaced.ID] = struct{}{}
+	} else {
+		delete(c.active, namespaced.ID)
+	}
+
+	return c.consumer.Container(&namespaced)
+}
+
+func (c *multiConsumer) Close(err error) {
+	if err != nil {
+		logger.Error("producer %s is closed because %s", c.name, err)
+
+		// containers of a failed producer can't be updated anymore
+		c.mux.Lock()
+		for id := range c.active {
+			c.consumer.Container(&baker.Container{
+				ID: id,
+			})
+		}
+		c.active = make(map[string]struct{})
+		c.mux.Unlock()
+	}
+
+	c.done(c.name, err)
+}
+
+// NewMulti creates a producer which merges producers by their names
+func NewMulti(producers map[string]Producer) *Multi {
+	return &Multi{
+		producers: producers,
+	}
+}
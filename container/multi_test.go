@@ -0,0 +1,98 @@
+package container_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/container"
+)
+
+// fakeProducer pushes its containers and is closed once stop is closed
+type fakeProducer struct {
+	containers []*baker.Container
+	stop       chan struct{}
+	err        error
+}
+
+func (p *fakeProducer) Pipe(consumer container.Consumer) {
+	for _, c := range p.containers {
+		consumer.Container(c)
+	}
+
+	<-p.stop
+	consumer.Close(p.err)
+}
+
+func TestMulti(t *testing.T) {
+	docker := &fakeProducer{
+		containers: []*baker.Container{{ID: "1", Active: true}},
+		stop:       make(chan struct{}),
+	}
+
+	file := &fakeProducer{
+		containers: []*baker.Container{{ID: "1", Active: true}},
+		stop:       make(chan struct{}),
+		err:        errors.New("file is removed"),
+	}
+
+	multi := container.NewMulti(map[string]container.Producer{
+		"docker": docker,
+		"file":   file,
+	})
+	consumer := pipe(t, multi)
+
+	// same ids of different producers don't collide
+	seen := map[string]bool{}
+	seen[consumer.next().ID] = true
+	seen[consumer.next().ID] = true
+	if !seen["docker:1"] || !seen["file:1"] {
+		t.Fatalf("expected namespaced ids but got %v", seen)
+	}
+
+	if docker.containers[0].ID != "1" {
+		t.Fatal("producer's container should not be changed")
+	}
+
+	// failed producer's containers are removed and others keep running
+	close(file.stop)
+
+	removed := consumer.next()
+	if removed.ID != "file:1" || removed.Active {
+		t.Fatalf("expected file:1 to be removed but got %+v", removed)
+	}
+
+	select {
+	case err := <-consumer.closed:
+		t.Fatalf("consumer should not be closed but closed with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(docker.stop)
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatalf("expected consumer to be closed without error but got %s", err)
+	}
+}
+
+func TestMultiAllFailed(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+
+	closed := make(chan error, 1)
+
+	multi := container.NewMulti(map[string]container.Producer{
+		"a": &fakeProducer{stop: stop, err: errors.New("failed")},
+		"b": &fakeProducer{stop: stop, err: errors.New("failed")},
+	})
+	multi.Pipe(&DummyConsumer{
+		close: func(err error) {
+			closed <- err
+		},
+	})
+
+	if err := <-closed; err == nil {
+		t.Fatal("expected an error once all producers failed")
+	}
+}
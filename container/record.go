@@ -0,0 +1,247 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Record is a single line of a recording. Addresses and errors can't be
+// encoded as json, so they are flattened
+type Record struct {
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id,omitempty"`
+	Active bool      `json:"active,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Port   int       `json:"port,omitempty"`
+	SSL    bool      `json:"ssl,omitempty"`
+	// HasPing is false for containers without a ping address, Ping is the path of it
+	HasPing bool              `json:"has_ping,omitempty"`
+	Ping    string            `json:"ping,omitempty"`
+	TLS     *baker.TLS        `json:"tls,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Config  *baker.Config     `json:"config,omitempty"`
+	Err     string            `json:"error,omitempty"`
+	// Closed is set once producer is closed, Err is the error which producer is closed with
+	Closed bool `json:"closed,omitempty"`
+}
+
+// NewRecord creates a record of container
+func NewRecord(t time.Time, container *baker.Container) *Record {
+	record := &Record{
+		Time:   t,
+		ID:     container.ID,
+		Active: container.Active,
+		TLS:    container.TLS,
+		Labels: container.Labels,
+		Config: container.Config,
+	}
+
+	if container.Addr != nil {
+		record.Host = container.Addr.Host()
+		record.Port = container.Addr.Port()
+		record.SSL = container.Addr.Secure()
+	}
+
+	if container.PingAddr != nil {
+		record.HasPing = true
+		record.Ping = container.PingAddr.Path()
+	}
+
+	if container.Err != nil {
+		record.Err = container.Err.Error()
+	}
+
+	return record
+}
+
+// Container recreates the recorded container
+func (r *Record) Container() *baker.Container {
+	container := &baker.Container{
+		ID:     r.ID,
+		Active: r.Active,
+		TLS:    r.TLS,
+		Labels: r.Labels,
+		Config: r.Config,
+	}
+
+	if r.Host != "" {
+		container.Addr = endpoint.NewAddr(r.Host, r.Port, r.SSL)
+	}
+
+	if r.HasPing && container.Addr != nil {
+		container.PingAddr = endpoint.NewHTTPAddr(container.Addr, r.Ping)
+	}
+
+	if r.Err != "" {
+		container.Err = errors.New(r.Err)
+	}
+
+	return container
+}
+
+// Recorder wraps a producer and writes every container it pushes, as a line of json, into a writer.
+// Recordings can be played back by Replay
+type Recorder struct {
+	producer Producer
+	mux      sync.Mutex
+	encoder  *json.Encoder
+}
+
+var _ Producer = (*Recorder)(nil)
+
+// Pipe runs the wrapped producer and records its containers before passing them to consumer
+// NOTE: this method is blocking call
+func (r *Recorder) Pipe(consumer Consumer) {
+	r.producer.Pipe(&recordConsumer{
+		recorder: r,
+		consumer: consumer,
+	})
+}
+
+// Stop stops the wrapped producer, if it can be stopped
+func (r *Recorder) Stop() {
+	if stopper, ok := r.producer.(interface{ Stop() }); ok {
+		stopper.Stop()
+	}
+}
+
+func (r *Recorder) write(record *Record) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// recording is only for debugging, so it never breaks producer
+	if err := r.encoder.Encode(record); err != nil {
+		logger.Error("failed to record %s because %s", record.ID, err)
+	}
+}
+
+type recordConsumer struct {
+	recorder *Recorder
+	consumer Consumer
+}
+
+var _ Consumer = (*recordConsumer)(nil)
+
+func (c *recordConsumer) Container(container *baker.Container) error {
+	c.recorder.write(NewRecord(time.Now(), container))
+	return c.consumer.Container(container)
+}
+
+func (c *recordConsumer) Close(err error) {
+	record := &Record{
+		Time:   time.Now(),
+		Closed: true,
+	}
+
+	if err != nil {
+		record.Err = err.Error()
+	}
+
+	c.recorder.write(record)
+	c.consumer.Close(err)
+}
+
+// NewRecorder creates a producer which records containers of producer into w
+func NewRecorder(producer Producer, w io.Writer) *Recorder {
+	return &Recorder{
+		producer: producer,
+		encoder:  json.NewEncoder(w),
+	}
+}
+
+// Replay is an implementation of container producer which plays back a recording of Recorder.
+// Delays between records are kept and divided by speed, so speed 2 plays twice as fast.
+// If speed is zero, records are played without any delay
+type Replay struct {
+	reader io.Reader
+	speed  float64
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var _ Producer = (*Replay)(nil)
+
+// Pipe pushes recorded containers. consumer is closed once recording ends,
+// with the recorded error if producer was closed with one
+// NOTE: this method is blocking call
+func (r *Replay) Pipe(consumer Consumer) {
+	scanner := bufio.NewScanner(r.reader)
+	// labels and configs can make lines longer than scanner's default limit
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var previous time.Time
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			consumer.Close(fmt.Errorf("failed to parse line %d of recording because %s", line, err))
+			return
+		}
+
+		if !previous.IsZero() && r.speed > 0 {
+			delay := time.Duration(float64(record.Time.Sub(previous)) / r.speed)
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-r.ctx.Done():
+					consumer.Close(nil)
+					return
+				}
+			}
+		}
+		previous = record.Time
+
+		if r.ctx.Err() != nil {
+			consumer.Close(nil)
+			return
+		}
+
+		if record.Closed {
+			if record.Err != "" {
+				consumer.Close(errors.New(record.Err))
+				return
+			}
+
+			consumer.Close(nil)
+			return
+		}
+
+		consumer.Container(record.Container())
+	}
+
+	consumer.Close(scanner.Err())
+}
+
+// Stop terminates playing back
+func (r *Replay) Stop() {
+	r.cancel()
+}
+
+// NewReplay creates a producer which plays back recording from reader at given speed
+func NewReplay(reader io.Reader, speed float64) *Replay {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Replay{
+		reader: reader,
+		speed:  speed,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
@@ -0,0 +1,142 @@
+package container_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/container"
+	"github.com/alinz/baker/pkg/endpoint"
+)
+
+func TestRecordReplay(t *testing.T) {
+	addr := endpoint.NewAddr("10.0.0.1", 8000, true)
+
+	producer := &fakeProducer{
+		containers: []*baker.Container{
+			{
+				ID:       "1",
+				Active:   true,
+				Addr:     addr,
+				PingAddr: endpoint.NewHTTPAddr(addr, "/config"),
+				TLS:      &baker.TLS{ServerName: "api"},
+				Labels:   map[string]string{"baker.domain": "example.com"},
+				Config:   &baker.Config{Domain: "example.com", Path: "/*", Ready: true},
+			},
+			{ID: "2", Err: errors.New("failed to inspect")},
+			{ID: "1"},
+			// inline config doesn't need a ping address
+			{ID: "3", Active: true, Addr: addr, Config: &baker.Config{Domain: "example.com", Path: "/*", Ready: true}},
+		},
+		stop: make(chan struct{}),
+		err:  errors.New("connection is lost"),
+	}
+	close(producer.stop)
+
+	var recording bytes.Buffer
+	recorded := make([]*baker.Container, 0)
+
+	container.NewRecorder(producer, &recording).Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			recorded = append(recorded, container)
+			return nil
+		},
+		close: func(err error) {},
+	})
+
+	if lines := strings.Count(recording.String(), "\n"); lines != 5 {
+		t.Fatalf("expected 5 lines but got %d:\n%s", lines, recording.String())
+	}
+
+	replayed := make([]*baker.Container, 0)
+	var closed error
+
+	container.NewReplay(&recording, 0).Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			replayed = append(replayed, container)
+			return nil
+		},
+		close: func(err error) {
+			closed = err
+		},
+	})
+
+	if closed == nil || closed.Error() != "connection is lost" {
+		t.Fatalf("expected recorded error but got %v", closed)
+	}
+
+	if len(replayed) != len(recorded) {
+		t.Fatalf("expected %d containers but got %d", len(recorded), len(replayed))
+	}
+
+	first := replayed[0]
+	if first.ID != "1" || !first.Active || first.Addr.String() != addr.String() || !first.Addr.Secure() ||
+		first.PingAddr.String() != "https://10.0.0.1:8000/config" || first.TLS.ServerName != "api" ||
+		first.Labels["baker.domain"] != "example.com" || first.Config.Domain != "example.com" {
+		t.Fatalf("unexpected container %+v", first)
+	}
+
+	second := replayed[1]
+	if second.ID != "2" || second.Active || second.Addr != nil || second.Err == nil || second.Err.Error() != "failed to inspect" {
+		t.Fatalf("unexpected container %+v", second)
+	}
+
+	if third := replayed[2]; third.ID != "1" || third.Active {
+		t.Fatalf("unexpected container %+v", third)
+	}
+
+	if fourth := replayed[3]; fourth.ID != "3" || fourth.Addr == nil || fourth.PingAddr != nil {
+		t.Fatalf("expected container without ping address but got %+v", fourth)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	recording := `{"time":"2020-01-01T00:00:00Z","id":"1","active":true,"host":"10.0.0.1","port":8000}
+{"time":"2020-01-01T00:00:00.4Z","id":"1"}
+`
+
+	testCases := []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{speed: 1, min: 400 * time.Millisecond, max: 5 * time.Second},
+		{speed: 4, min: 100 * time.Millisecond, max: 400 * time.Millisecond},
+		{speed: 0, min: 0, max: 100 * time.Millisecond},
+	}
+
+	for _, testCase := range testCases {
+		start := time.Now()
+
+		container.NewReplay(strings.NewReader(recording), testCase.speed).Pipe(&DummyConsumer{
+			container: func(container *baker.Container) error { return nil },
+			close: func(err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		})
+
+		elapsed := time.Since(start)
+		if elapsed < testCase.min || elapsed > testCase.max {
+			t.Fatalf("expected replay at speed %v to take between %s and %s but took %s", testCase.speed, testCase.min, testCase.max, elapsed)
+		}
+	}
+}
+
+func TestReplayInvalidRecording(t *testing.T) {
+	var closed error
+
+	container.NewReplay(strings.NewReader("{\"id\": \"1\"}\n{"), 0).Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error { return nil },
+		close: func(err error) {
+			closed = err
+		},
+	})
+
+	if closed == nil || !strings.Contains(closed.Error(), "line 2") {
+		t.Fatalf("expected error for line 2 but got %v", closed)
+	}
+}
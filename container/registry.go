@@ -0,0 +1,297 @@
+package container
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/interval"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// RegistryPath is the path which services register themselves on. Heartbeats are sent
+// using PUT and deregistering using DELETE on RegistryPath/<id>
+const RegistryPath = "/register"
+
+// registryMaxBodySize limits the body of a register request
+const registryMaxBodySize = 1 << 20
+
+// RegistryDefaultTTL is used for registrations which don't set their ttl and
+// RegistryCheckInterval is how often expired registrations are removed
+var (
+	RegistryDefaultTTL    = 30 * time.Second
+	RegistryCheckInterval = 1 * time.Second
+)
+
+// Registration is the body of a register request
+type Registration struct {
+	FileUpstream
+	Labels map[string]string `json:"labels"`
+	// TTL is a duration, such as 30s. Registration is removed if no
+	// heartbeat is received within TTL
+	TTL string `json:"ttl"`
+}
+
+// registration is a registered service which expires if its heartbeats stop
+type registration struct {
+	container *baker.Container
+	ttl       time.Duration
+	expires   time.Time
+}
+
+// Registry is an implementation of container producer which lets services, that can't be
+// discovered, such as ones running on VMs, register themselves through an http api.
+// Registry is an http.Handler and every request must have the token as a bearer token
+type Registry struct {
+	token         string
+	ctx           context.Context
+	cancel        context.CancelFunc
+	mux           sync.Mutex
+	consumer      Consumer
+	registrations map[string]*registration
+	snapshot      *snapshot
+	// pending changes are pushed to consumer by flush without holding mux.
+	// flushMux keeps them in order
+	pending  []*baker.Container
+	flushMux sync.Mutex
+}
+
+var _ Producer = (*Registry)(nil)
+var _ interval.Ticker = (*Registry)(nil)
+var _ http.Handler = (*Registry)(nil)
+
+// Pipe pushes registered services and keeps removing the expired ones
+// NOTE: this method is blocking call
+func (r *Registry) Pipe(consumer Consumer) {
+	r.mux.Lock()
+	r.consumer = consumer
+	r.update()
+	r.mux.Unlock()
+
+	r.flush()
+
+	interval.Run(r.ctx, r, RegistryCheckInterval)
+
+	consumer.Close(nil)
+}
+
+// Stop terminates removing expired registrations
+func (r *Registry) Stop() {
+	r.cancel()
+}
+
+// Tick removes registrations which their ttl has been passed
+// NOTE: do not call this method, this will be called by interval.Run package.
+func (r *Registry) Tick(ctx context.Context) error {
+	defer r.flush()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	now := time.Now()
+	expired := false
+
+	for id, reg := range r.registrations {
+		if now.Before(reg.expires) {
+			continue
+		}
+
+		logger.Info("registration of %s is expired", id)
+		delete(r.registrations, id)
+		expired = true
+	}
+
+	if expired {
+		r.update()
+	}
+
+	return nil
+}
+
+// update queues changes of registrations, if Pipe has been called.
+// They are pushed to consumer by flush
+// NOTE: r.mux must be held
+func (r *Registry) update() {
+	if r.consumer == nil {
+		return
+	}
+
+	containers := make([]*baker.Container, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		containers = append(containers, reg.container)
+	}
+
+	r.pending = append(r.pending, r.snapshot.update(containers)...)
+}
+
+// flush pushes queued changes to consumer. consumer might be slow, so
+// r.mux is not held while pushing and registrations can still be changed
+// NOTE: r.mux must not be held
+func (r *Registry) flush() {
+	r.flushMux.Lock()
+	defer r.flushMux.Unlock()
+
+	r.mux.Lock()
+	consumer := r.consumer
+	pending := r.pending
+	r.pending = nil
+	r.mux.Unlock()
+
+	for _, container := range pending {
+		consumer.Container(container)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if r.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.URL.Path == RegistryPath {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.register(w, req)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, RegistryPath+"/")
+	if id == req.URL.Path || id == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		r.heartbeat(w, id)
+	case http.MethodDelete:
+		r.deregister(w, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// register adds a new registration or replaces an existing one with the same id
+func (r *Registry) register(w http.ResponseWriter, req *http.Request) {
+	registration := &Registration{}
+
+	body := http.MaxBytesReader(w, req.Body, registryMaxBodySize)
+
+	err := json.NewDecoder(body).Decode(registration)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse registration because %s", err), http.StatusBadRequest)
+		return
+	}
+
+	reg, err := registration.registration()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mux.Lock()
+	r.registrations[registration.ID] = reg
+	r.update()
+	r.mux.Unlock()
+
+	r.flush()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// heartbeat extends the registration of id by its ttl. Unknown ids, e.g. after
+// baker restarts, get 404, so the service knows that it needs to register again
+func (r *Registry) heartbeat(w http.ResponseWriter, id string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	reg, ok := r.registrations[id]
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+
+	reg.expires = time.Now().Add(reg.ttl)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deregister removes the registration of id
+func (r *Registry) deregister(w http.ResponseWriter, id string) {
+	r.mux.Lock()
+
+	if _, ok := r.registrations[id]; !ok {
+		r.mux.Unlock()
+		http.NotFound(w, nil)
+		return
+	}
+
+	delete(r.registrations, id)
+	r.update()
+	r.mux.Unlock()
+
+	r.flush()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *Registration) registration() (*registration, error) {
+	if r.ID == "" || strings.Contains(r.ID, "/") {
+		return nil, fmt.Errorf("registration requires an id without '/'")
+	}
+
+	if r.Host == "" || r.Port <= 0 {
+		return nil, fmt.Errorf("registration '%s' requires host and port", r.ID)
+	}
+
+	if r.Ping == "" && r.Config == nil {
+		return nil, fmt.Errorf("registration '%s' requires either ping or config", r.ID)
+	}
+
+	// tls refers to baker's local files, so only operator can set it
+	if r.TLS != nil {
+		return nil, fmt.Errorf("registration '%s' can not set tls", r.ID)
+	}
+
+	ttl := RegistryDefaultTTL
+	if r.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(r.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("registration '%s' has invalid ttl '%s'", r.ID, r.TTL)
+		}
+	}
+
+	container := r.container()
+	container.Labels = r.Labels
+
+	return &registration{
+		container: container,
+		ttl:       ttl,
+		expires:   time.Now().Add(ttl),
+	}, nil
+}
+
+// NewRegistry creates a producer which services register themselves on using token.
+// Registry needs to be served, e.g. by http.ListenAndServe, to receive registrations
+func NewRegistry(token string) *Registry {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Registry{
+		token:         token,
+		ctx:           ctx,
+		cancel:        cancel,
+		registrations: make(map[string]*registration),
+		snapshot:      newSnapshot(),
+	}
+}
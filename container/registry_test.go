@@ -0,0 +1,171 @@
+package container_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/container"
+)
+
+func TestRegistry(t *testing.T) {
+	container.RegistryCheckInterval = 10 * time.Millisecond
+
+	registry := container.NewRegistry("secret")
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	request := func(method string, path string, token string, body string) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// registrations before Pipe are pushed once it's called
+	status := request(http.MethodPost, "/register", "secret",
+		`{"id": "vm-1", "host": "10.0.0.1", "port": 8000, "ping": "/config", "ttl": "200ms", "labels": {"baker.domain": "example.com"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", status)
+	}
+
+	consumer := pipe(t, registry)
+
+	vm1 := consumer.expect("vm-1", true)
+	if vm1.PingAddr.String() != "http://10.0.0.1:8000/config" || vm1.Labels["baker.domain"] != "example.com" {
+		t.Fatalf("unexpected container %+v", vm1)
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/register", "wrong", `{"id": "vm-2", "host": "10.0.0.2", "port": 8000, "ping": "/config"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/register", "secret", `{"id": "vm-2", "host": "10.0.0.2", "port": 8000}`, http.StatusBadRequest},
+		{http.MethodPost, "/register", "secret", `{"id": "vm-2", "host": "10.0.0.2", "port": 8000, "ping": "/config", "ttl": "-1s"}`, http.StatusBadRequest},
+		{http.MethodPost, "/register", "secret", `{"id": "vm-2", "host": "10.0.0.2", "port": 8000, "ping": "/config", "tls": {"insecure_skip_verify": true}}`, http.StatusBadRequest},
+		{http.MethodPost, "/register", "secret", `{"id": "vm-2", "labels": {"a": "` + strings.Repeat("a", 2<<20) + `"}}`, http.StatusBadRequest},
+		{http.MethodPut, "/register/vm-2", "secret", ``, http.StatusNotFound},
+		{http.MethodGet, "/register", "secret", ``, http.StatusMethodNotAllowed},
+	}
+
+	for _, testCase := range testCases {
+		status := request(testCase.method, testCase.path, testCase.token, testCase.body)
+		if status != testCase.status {
+			t.Fatalf("expected %d for %s %s but got %d", testCase.status, testCase.method, testCase.path, status)
+		}
+	}
+
+	status = request(http.MethodPost, "/register", "secret",
+		`{"id": "vm-2", "host": "10.0.0.2", "port": 8000, "config": {"domain": "example.com", "path": "/*", "ready": true}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", status)
+	}
+	consumer.expect("vm-2", true)
+
+	// heartbeats keep vm-1 registered beyond its ttl
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if status := request(http.MethodPut, "/register/vm-1", "secret", ``); status != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", status)
+		}
+	}
+
+	select {
+	case c := <-consumer.received:
+		t.Fatalf("unexpected container %+v", c)
+	default:
+	}
+
+	// once heartbeats stop, vm-1 is expired
+	consumer.expect("vm-1", false)
+
+	if status := request(http.MethodDelete, "/register/vm-2", "secret", ``); status != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", status)
+	}
+	consumer.expect("vm-2", false)
+
+	registry.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistrySlowConsumer(t *testing.T) {
+	registry := container.NewRegistry("secret")
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	release := make(chan struct{})
+	received := make(chan *baker.Container, 10)
+
+	go registry.Pipe(&DummyConsumer{
+		container: func(container *baker.Container) error {
+			<-release
+			received <- container
+			return nil
+		},
+		close: func(err error) {},
+	})
+	defer registry.Stop()
+
+	request := func(method string, path string, body string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	go request(http.MethodPost, "/register", `{"id": "vm-1", "host": "10.0.0.1", "port": 8000, "ping": "/config"}`)
+
+	// heartbeat is answered while consumer is still blocked by vm-1
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/register/vm-1", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected heartbeat to succeed but got %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+
+	if c := <-received; c.ID != "vm-1" || !c.Active {
+		t.Fatalf("unexpected container %+v", c)
+	}
+}
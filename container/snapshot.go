@@ -0,0 +1,54 @@
+package container
+
+import (
+	"sort"
+
+	"github.com/alinz/baker"
+)
+
+// snapshot keeps track of containers which have been pushed by a producer that
+// periodically lists all containers, so only the changes are pushed to consumer
+type snapshot struct {
+	containers map[string]*baker.Container
+}
+
+// update replaces snapshot with given containers and returns containers which are
+// new or changed, plus an inactive container for each one which no longer exists
+func (s *snapshot) update(containers []*baker.Container) []*baker.Container {
+	current := make(map[string]*baker.Container, len(containers))
+	changes := make([]*baker.Container, 0)
+
+	for _, container := range containers {
+		current[container.ID] = container
+
+		previous, ok := s.containers[container.ID]
+		if !ok || !previous.Equal(container) {
+			changes = append(changes, container)
+		}
+	}
+
+	for id, previous := range s.containers {
+		if _, ok := current[id]; ok || !previous.Active {
+			continue
+		}
+
+		changes = append(changes, &baker.Container{
+			ID: id,
+		})
+	}
+
+	s.containers = current
+
+	// makes the order of changes predictable
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].ID < changes[j].ID
+	})
+
+	return changes
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		containers: make(map[string]*baker.Container),
+	}
+}
@@ -0,0 +1,258 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/interval"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Swarm is an implementation of Docker Swarm's services producer. It periodically lists
+// services and their running tasks and produces a container object for each task
+type Swarm struct {
+	client       *http.Client
+	addr         endpoint.HTTPAddr
+	pollInterval time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+	consumer     Consumer
+	snapshot     *snapshot
+}
+
+var _ Producer = (*Swarm)(nil)
+var _ interval.Ticker = (*Swarm)(nil)
+
+// Pipe starts polling Swarm's services and tasks and pushes changes to consumer
+// NOTE: this method is blocking call
+func (s *Swarm) Pipe(consumer Consumer) {
+	s.consumer = consumer
+
+	// already running tasks need to be registered without waiting for the first tick
+	err := s.sync()
+	if err != nil {
+		consumer.Close(err)
+		return
+	}
+
+	interval.Run(s.ctx, s, s.pollInterval)
+
+	consumer.Close(nil)
+}
+
+// Stop terminates polling, Pipe returns once the current poll is done
+func (s *Swarm) Stop() {
+	s.cancel()
+}
+
+// Tick polls Swarm once, errors are logged and polling continues on next tick
+// NOTE: do not call this method, this will be called by interval.Run package.
+func (s *Swarm) Tick(ctx context.Context) error {
+	err := s.sync()
+	if err != nil && ctx.Err() == nil {
+		logger.Error("failed to sync swarm services because %s", err)
+	}
+
+	return nil
+}
+
+// sync lists services and tasks and pushes containers which have been changed
+func (s *Swarm) sync() error {
+	services, err := s.services()
+	if err != nil {
+		return err
+	}
+
+	tasks, err := s.tasks()
+	if err != nil {
+		return err
+	}
+
+	containers := make([]*baker.Container, 0, len(tasks))
+	for _, task := range tasks {
+		service, ok := services[task.ServiceID]
+		if !ok || task.Status.State != "running" || task.DesiredState != "running" {
+			continue
+		}
+
+		// services which are not attached to baker's network are ignored
+		if _, ok := service.labels()[LabelNetwork]; !ok {
+			continue
+		}
+
+		containers = append(containers, task.containers(service)...)
+	}
+
+	for _, container := range s.snapshot.update(containers) {
+		s.consumer.Container(container)
+	}
+
+	return nil
+}
+
+type swarmService struct {
+	ID   string `json:"ID"`
+	Spec struct {
+		Name         string            `json:"Name"`
+		Labels       map[string]string `json:"Labels"`
+		TaskTemplate struct {
+			ContainerSpec struct {
+				Labels map[string]string `json:"Labels"`
+			} `json:"ContainerSpec"`
+		} `json:"TaskTemplate"`
+	} `json:"Spec"`
+}
+
+// labels returns container's labels overridden by service's labels
+func (s *swarmService) labels() map[string]string {
+	labels := make(map[string]string)
+
+	for key, value := range s.Spec.TaskTemplate.ContainerSpec.Labels {
+		labels[key] = value
+	}
+
+	for key, value := range s.Spec.Labels {
+		labels[key] = value
+	}
+
+	// anyone who can create a service on the manager can set its labels,
+	// so they can't point baker to its local tls files
+	for key := range labels {
+		if isTLSFileLabel(key) {
+			logger.Debug("label %s of service %s is ignored", key, s.Spec.Name)
+			delete(labels, key)
+		}
+	}
+
+	return labels
+}
+
+type swarmTask struct {
+	ID           string `json:"ID"`
+	ServiceID    string `json:"ServiceID"`
+	DesiredState string `json:"DesiredState"`
+	Status       struct {
+		State string `json:"State"`
+	} `json:"Status"`
+	NetworksAttachments []struct {
+		Network struct {
+			Spec struct {
+				Name string `json:"Name"`
+			} `json:"Spec"`
+		} `json:"Network"`
+		Addresses []string `json:"Addresses"`
+	} `json:"NetworksAttachments"`
+}
+
+// containers returns a container object for each endpoint of task.
+// task's address on the network defined by baker.network is used
+func (t *swarmTask) containers(service *swarmService) []*baker.Container {
+	labels := service.labels()
+
+	ip := ""
+	for _, attachment := range t.NetworksAttachments {
+		if attachment.Network.Spec.Name != labels[LabelNetwork] || len(attachment.Addresses) == 0 {
+			continue
+		}
+
+		// addresses are in CIDR notation, e.g. 10.0.1.5/24
+		addr, _, err := net.ParseCIDR(attachment.Addresses[0])
+		if err == nil {
+			ip = addr.String()
+		}
+	}
+
+	if ip == "" {
+		logger.Debug("network %s not exisits in label for task %s of service %s", labels[LabelNetwork], t.ID, service.Spec.Name)
+
+		return []*baker.Container{
+			{
+				ID:  t.ID,
+				Err: fmt.Errorf("network '%s' not exists in labels", labels[LabelNetwork]),
+			},
+		}
+	}
+
+	containers := make([]*baker.Container, 0, 1)
+	for id, endpointLabels := range endpointsLabels(t.ID, labels) {
+		containers = append(containers, containerFromLabels(id, ip, endpointLabels))
+	}
+
+	return containers
+}
+
+func (s *Swarm) services() (map[string]*swarmService, error) {
+	payload := []*swarmService{}
+
+	err := s.get("/services", nil, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*swarmService, len(payload))
+	for _, service := range payload {
+		services[service.ID] = service
+	}
+
+	return services, nil
+}
+
+func (s *Swarm) tasks() ([]*swarmTask, error) {
+	query := url.Values{}
+	query.Set("filters", `{"desired-state":["running"]}`)
+
+	payload := []*swarmTask{}
+
+	err := s.get("/tasks", query, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// get sends a GET request and decodes the response into payload
+func (s *Swarm) get(path string, query url.Values, payload interface{}) error {
+	addr := s.addr.WithPath(path).String()
+	if len(query) > 0 {
+		addr += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, addr, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %s, swarm responded with status %d", path, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(payload)
+}
+
+// NewSwarm creates a new Swarm watcher which polls services and tasks on every pollInterval
+func NewSwarm(client *http.Client, addr string, pollInterval time.Duration) *Swarm {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Swarm{
+		client:       client,
+		addr:         endpoint.ParseHTTPAddr(addr),
+		pollInterval: pollInterval,
+		ctx:          ctx,
+		cancel:       cancel,
+		snapshot:     newSnapshot(),
+	}
+}
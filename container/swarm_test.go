@@ -0,0 +1,64 @@
+package container_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+)
+
+func TestSwarm(t *testing.T) {
+	server := mockServer(t, "./fixtures/swarm/scenario1")
+	defer server.Close()
+
+	swarm := container.NewSwarm(server.Client(), server.URL, 10*time.Millisecond)
+	consumer := pipe(t, swarm)
+
+	type update struct {
+		id     string
+		active bool
+		addr   string
+	}
+
+	expected := []update{
+		// task-2 is still starting
+		{id: "task-1", active: true, addr: "10.0.1.3:8000"},
+		// scaled to 3 replicas
+		{id: "task-2", active: true, addr: "10.0.1.4:8000"},
+		{id: "task-3", active: true, addr: "10.0.1.5:8000"},
+		// rolling update replaces task-1 with task-4
+		{id: "task-1", active: false},
+		{id: "task-4", active: true, addr: "10.0.1.6:8000"},
+	}
+
+	for _, e := range expected {
+		c := consumer.expect(e.id, e.active)
+
+		if e.active && c.Addr.String() != e.addr {
+			t.Fatalf("expected task %s to have address %s but got %s", c.ID, e.addr, c.Addr)
+		}
+
+		// service's labels override container's labels
+		if e.active && c.Labels["baker.domain"] != "example.com" {
+			t.Fatalf("expected service's labels but got %v", c.Labels)
+		}
+
+		// labels can't point baker to its local tls files, only server name is kept
+		if e.active && (c.TLS == nil || c.TLS.ServerName != "web.internal" || c.TLS.CA != "" || c.TLS.Key != "") {
+			t.Fatalf("expected only server name to be set but got %+v", c.TLS)
+		}
+	}
+
+	// no more changes once swarm is stable
+	select {
+	case c := <-consumer.received:
+		t.Fatalf("unexpected update %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	swarm.Stop()
+
+	if err := <-consumer.closed; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,8 +5,101 @@ import (
 	"github.com/alinz/baker/rule"
 )
 
+// Retry describes how a failed request is retried on a different container.
+// Only requests which have failed before receiving any response are retried.
+// Requests with idempotent methods are retried on any failure, other requests
+// only if connection to container could not be established. Requests' bodies up to
+// MaxBodySize bytes are buffered, larger requests are never retried.
+// Budget limits retries to a ratio of requests, default is 0.2
+type Retry struct {
+	Attempts      int      `json:"attempts"`
+	PerTryTimeout Duration `json:"per_try_timeout"`
+	MaxBodySize   int64    `json:"max_body_size"`
+	Budget        float64  `json:"budget"`
+}
+
 type Rules struct {
 	RequestUpdaters rule.RequestUpdaters `json:"request_updaters"`
+	Retry           *Retry               `json:"retry"`
+}
+
+// TLS describes how baker connects to a secure upstream.
+// CA, Cert and Key are file paths which need to be accessible by baker
+type TLS struct {
+	CA                 string `json:"ca"`
+	ServerName         string `json:"server_name"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// LoadBalancer selects which strategy is used to pick a container
+// among containers which share the same domain and path.
+// Type can be one of round_robin, weighted_round_robin, least_conn, p2c and ewma.
+// If it's empty, round_robin will be used
+type LoadBalancer struct {
+	Type string `json:"type"`
+}
+
+// Affinity pins a client to one container.
+// Type can be one of cookie, header and ip.
+// cookie: a signed cookie which names the container is set on response.
+// header: value of Header is hashed on a consistent hash ring.
+// ip: client's ip is hashed on a consistent hash ring.
+type Affinity struct {
+	Type   string `json:"type"`
+	Cookie string `json:"cookie"`
+	Header string `json:"header"`
+	// MaxAge is cookie's max age in seconds. if it's zero, cookie
+	// only lives as long as the browser session
+	MaxAge int `json:"max_age"`
+}
+
+// HealthCheck describes how containers are actively probed.
+// A container is considered unhealthy after UnhealthyThreshold consecutive
+// failed probes and healthy again after HealthyThreshold consecutive successful probes.
+// If ExpectedStatus is empty, any 2xx and 3xx status is accepted. If ExpectedBody is set,
+// response's body must contain it.
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	ExpectedStatus     []int    `json:"expected_status"`
+	ExpectedBody       string   `json:"expected_body"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+// OutlierDetection ejects a container from load balancing based on proxied traffic.
+// A container is ejected after ConsecutiveFailures failures in a row, or once its error rate
+// within Interval reaches ErrorRate and it has served at least MinRequests requests.
+// Failures are connection errors and 5xx responses. Ejection lasts BaseEjection and doubles
+// on every consecutive ejection up to MaxEjection. At most MaxEjectionPercent of containers,
+// 50 by default, are ejected at the same time, the rest of ejected ones keep receiving requests
+type OutlierDetection struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	ErrorRate           float64  `json:"error_rate"`
+	MinRequests         int      `json:"min_requests"`
+	Interval            Duration `json:"interval"`
+	BaseEjection        Duration `json:"base_ejection"`
+	MaxEjection         Duration `json:"max_ejection"`
+	MaxEjectionPercent  int      `json:"max_ejection_percent"`
+}
+
+// CircuitBreaker stops sending requests to a container which keeps failing.
+// Circuit opens after ConsecutiveFailures failures in a row, or once failure ratio
+// within Interval reaches FailureRatio and at least MinRequests requests have been sent.
+// After OpenTimeout, circuit becomes half-open and lets HalfOpenRequests requests through,
+// if all of them succeed, circuit closes, otherwise it opens again.
+// MaxPending limits number of in-flight requests to a container, zero means no limit.
+type CircuitBreaker struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	FailureRatio        float64  `json:"failure_ratio"`
+	MinRequests         int      `json:"min_requests"`
+	Interval            Duration `json:"interval"`
+	OpenTimeout         Duration `json:"open_timeout"`
+	HalfOpenRequests    int      `json:"half_open_requests"`
+	MaxPending          int      `json:"max_pending"`
 }
 
 type Config struct {
@@ -15,6 +108,16 @@ type Config struct {
 	Path       string `json:"path"`
 	Ready      bool   `json:"ready"`
 	Rules      Rules  `json:"rules"`
+	TLS        *TLS   `json:"tls"`
+
+	LoadBalancer LoadBalancer `json:"load_balancer"`
+	// Weight is used by weighted_round_robin, default is 1
+	Weight      int          `json:"weight"`
+	Affinity    *Affinity    `json:"affinity"`
+	HealthCheck *HealthCheck `json:"health_check"`
+
+	OutlierDetection *OutlierDetection `json:"outlier_detection"`
+	CircuitBreaker   *CircuitBreaker   `json:"circuit_breaker"`
 }
 
 type Container struct {
@@ -22,7 +125,14 @@ type Container struct {
 	Active   bool              `json:"active"`
 	Addr     endpoint.Addr     `json:"addr"`
 	PingAddr endpoint.HTTPAddr `json:"ping_addr"`
-	Err      error             `json:"error"`
+	TLS      *TLS              `json:"tls"`
+	// Labels are container's metadata, such as docker labels.
+	// They can be used by ConfigLoader to build config
+	Labels map[string]string `json:"labels"`
+	// Config is an inline config which is given by producer, e.g. file producer.
+	// It can be used by ConfigLoader instead of pinging the container
+	Config *Config `json:"config"`
+	Err    error   `json:"error"`
 }
 
 type Service struct {
@@ -30,3 +140,33 @@ type Service struct {
 	Config    *Config    `json:"config"`
 	Err       error      `json:"error"`
 }
+
+// Change describes why a service is passed to its consumer
+type Change int
+
+const (
+	// ServiceAdded is a service which its config has been loaded for the first time,
+	// or again after it has errored
+	ServiceAdded Change = iota + 1
+	// ServiceUpdated is a service which its config or container has been changed
+	ServiceUpdated
+	// ServiceErrored is a service which its config can't be loaded anymore
+	ServiceErrored
+	// ServiceRemoved is a service which its container is not active anymore
+	ServiceRemoved
+)
+
+func (c Change) String() string {
+	switch c {
+	case ServiceAdded:
+		return "added"
+	case ServiceUpdated:
+		return "updated"
+	case ServiceErrored:
+		return "errored"
+	case ServiceRemoved:
+		return "removed"
+	}
+
+	return "unknown"
+}
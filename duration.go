@@ -0,0 +1,47 @@
+package baker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration which can be decoded from json either as
+// a string such as "5s" or as number of nanoseconds
+type Duration time.Duration
+
+var _ json.Unmarshaler = (*Duration)(nil)
+var _ json.Marshaler = (*Duration)(nil)
+
+func (d *Duration) UnmarshalJSON(p []byte) error {
+	var value interface{}
+
+	err := json.Unmarshal(p, &value)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", p)
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Duration returns d as time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
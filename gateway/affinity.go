@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+const (
+	CookieAffinity = "cookie"
+	HeaderAffinity = "header"
+	IPAffinity     = "ip"
+
+	defaultAffinityCookie = "baker_affinity"
+	// ringReplicas is number of virtual nodes per backend on consistent hash ring
+	ringReplicas = 100
+)
+
+// AffinitySecret is used to sign affinity cookies. It's randomly generated
+// on start, it needs to be set to the same value if multiple baker instances
+// share the same clients
+var AffinitySecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// Affinity pins requests of a client to a backend.
+// Lookup and Pin will be called concurrently, Update is never called
+// concurrently with Lookup and Pin
+type Affinity interface {
+	// Lookup returns the backend which request is pinned to or nil
+	Lookup(r *http.Request) *Backend
+	// Pin makes sure the next requests of the client will be sent to given backend
+	Pin(w http.ResponseWriter, r *http.Request, backend *Backend)
+	// Update will be called whenever list of backends changes
+	Update(backends []*Backend)
+}
+
+// NewAffinity creates an affinity based on given config.
+// nil will be returned if config is nil or type is not supported
+func NewAffinity(config *baker.Affinity) Affinity {
+	if config == nil {
+		return nil
+	}
+
+	switch config.Type {
+	case CookieAffinity:
+		name := config.Cookie
+		if name == "" {
+			name = defaultAffinityCookie
+		}
+		return &cookieAffinity{
+			name:   name,
+			maxAge: config.MaxAge,
+			secret: AffinitySecret,
+		}
+	case HeaderAffinity:
+		header := config.Header
+		return &hashAffinity{
+			key: func(r *http.Request) string {
+				return r.Header.Get(header)
+			},
+		}
+	case IPAffinity:
+		return &hashAffinity{
+			key: clientIP,
+		}
+	default:
+		logger.Warn("affinity '%s' is not supported", config.Type)
+		return nil
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// cookieAffinity sets a signed cookie which contains backend's container id
+type cookieAffinity struct {
+	name     string
+	maxAge   int
+	secret   []byte
+	backends map[string]*Backend
+}
+
+func (c *cookieAffinity) sign(id string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// value encodes id and its signature as cookie's value
+func (c *cookieAffinity) value(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." + c.sign(id)
+}
+
+// id extracts id from cookie's value, empty string will be returned
+// if value has been tampered
+func (c *cookieAffinity) id(value string) string {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(c.sign(string(id)))) {
+		return ""
+	}
+
+	return string(id)
+}
+
+func (c *cookieAffinity) Lookup(r *http.Request) *Backend {
+	cookie, err := r.Cookie(c.name)
+	if err != nil {
+		return nil
+	}
+
+	return c.backends[c.id(cookie.Value)]
+}
+
+func (c *cookieAffinity) Pin(w http.ResponseWriter, r *http.Request, backend *Backend) {
+	if cookie, err := r.Cookie(c.name); err == nil && c.id(cookie.Value) == backend.Container.ID {
+		return
+	}
+
+	// request might be retried on another backend, only the last cookie is kept
+	c.unpin(w)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.name,
+		Value:    c.value(backend.Container.ID),
+		Path:     "/",
+		MaxAge:   c.maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// unpin removes affinity cookie which has been set on response,
+// other cookies are kept
+func (c *cookieAffinity) unpin(w http.ResponseWriter) {
+	header := w.Header()
+	prefix := c.name + "="
+
+	cookies := make([]string, 0, len(header["Set-Cookie"]))
+	for _, cookie := range header["Set-Cookie"] {
+		if !strings.HasPrefix(cookie, prefix) {
+			cookies = append(cookies, cookie)
+		}
+	}
+
+	if len(cookies) == 0 {
+		header.Del("Set-Cookie")
+		return
+	}
+
+	header["Set-Cookie"] = cookies
+}
+
+func (c *cookieAffinity) Update(backends []*Backend) {
+	c.backends = make(map[string]*Backend, len(backends))
+	for _, backend := range backends {
+		c.backends[backend.Container.ID] = backend
+	}
+}
+
+type ringNode struct {
+	hash    uint32
+	backend *Backend
+}
+
+// hashAffinity hashes a key extracted from request on a consistent hash ring.
+// once a backend is removed, only keys belong to that backend are remapped
+type hashAffinity struct {
+	key  func(r *http.Request) string
+	ring []ringNode
+}
+
+func hash(value string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return h.Sum32()
+}
+
+func (h *hashAffinity) Lookup(r *http.Request) *Backend {
+	key := h.key(r)
+	if key == "" || len(h.ring) == 0 {
+		return nil
+	}
+
+	value := hash(key)
+	i := sort.Search(len(h.ring), func(i int) bool {
+		return h.ring[i].hash >= value
+	})
+	if i == len(h.ring) {
+		i = 0
+	}
+
+	return h.ring[i].backend
+}
+
+func (h *hashAffinity) Pin(w http.ResponseWriter, r *http.Request, backend *Backend) {}
+
+func (h *hashAffinity) Update(backends []*Backend) {
+	ring := make([]ringNode, 0, len(backends)*ringReplicas)
+	for _, backend := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			ring = append(ring, ringNode{
+				hash:    hash(backend.Container.ID + "#" + strconv.Itoa(i)),
+				backend: backend,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	h.ring = ring
+}
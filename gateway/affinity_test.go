@@ -0,0 +1,167 @@
+package gateway_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+func affinityServices(affinity *baker.Affinity, count int) *gateway.Services {
+	services := gateway.NewServices()
+
+	for i := 0; i < count; i++ {
+		service := dummyService(fmt.Sprintf("%d", i+1))
+		service.Config.Affinity = affinity
+		services.Add(service)
+	}
+
+	return services
+}
+
+func TestCookieAffinity(t *testing.T) {
+	services := affinityServices(&baker.Affinity{Type: gateway.CookieAffinity}, 3)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+	w := httptest.NewRecorder()
+
+	first := services.Get(r)
+	services.Pin(w, r, first.Backend)
+	first.Done(time.Millisecond)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie but got %d", len(cookies))
+	}
+
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+
+		backend := services.Get(r)
+		services.Pin(w, r, backend.Backend)
+		backend.Done(time.Millisecond)
+
+		if backend.Container.ID != first.Container.ID {
+			t.Fatalf("expected backend %s but got %s", first.Container.ID, backend.Container.ID)
+		}
+
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("expected cookie not to be set again")
+		}
+	}
+
+	// once pinned backend is removed, a new backend is selected and pinned
+	services.Remove(first.Service)
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+
+	backend := services.Get(r)
+	services.Pin(w, r, backend.Backend)
+	backend.Done(time.Millisecond)
+
+	if backend.Container.ID == first.Container.ID {
+		t.Fatal("expected removed backend not to be selected")
+	}
+
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatal("expected cookie to be set for the new backend")
+	}
+}
+
+func TestCookieAffinityTampered(t *testing.T) {
+	services := affinityServices(&baker.Affinity{Type: gateway.CookieAffinity, Cookie: "sticky"}, 2)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+	w := httptest.NewRecorder()
+
+	backend := services.Get(r)
+	services.Pin(w, r, backend.Backend)
+	backend.Done(time.Millisecond)
+
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != "sticky" {
+		t.Fatalf("expected cookie name to be sticky but got %s", cookie.Name)
+	}
+
+	// a cookie which names backend 2 without a valid signature
+	cookie.Value = "Mg.invalid"
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+
+	backend = services.Get(r)
+	services.Pin(w, r, backend.Backend)
+	backend.Done(time.Millisecond)
+
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatal("expected tampered cookie to be replaced")
+	}
+}
+
+func TestHeaderAffinity(t *testing.T) {
+	services := affinityServices(&baker.Affinity{Type: gateway.HeaderAffinity, Header: "X-User"}, 5)
+
+	get := func(user string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+		r.Header.Set("X-User", user)
+
+		backend := services.Get(r)
+		backend.Done(time.Millisecond)
+		return backend.Container.ID
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = get(user)
+
+		if get(user) != before[user] {
+			t.Fatalf("expected %s to be pinned to %s", user, before[user])
+		}
+	}
+
+	removed := dummyService("3")
+	services.Remove(removed)
+
+	for user, id := range before {
+		after := get(user)
+		if id != "3" && after != id {
+			t.Fatalf("expected %s to stay on %s but moved to %s", user, id, after)
+		}
+
+		if after == "3" {
+			t.Fatalf("expected %s to be moved from removed backend", user)
+		}
+	}
+}
+
+func TestIPAffinity(t *testing.T) {
+	services := affinityServices(&baker.Affinity{Type: gateway.IPAffinity}, 3)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	first := services.Get(r)
+	first.Done(time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/test", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.1:%d", 2000+i)
+
+		backend := services.Get(r)
+		backend.Done(time.Millisecond)
+
+		if backend.Container.ID != first.Container.ID {
+			t.Fatalf("expected backend %s but got %s", first.Container.ID, backend.Container.ID)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package gateway
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/health"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// ewmaDecay is the time which an observed latency loses
+// most of its effect on ewma latency
+const ewmaDecay = 10 * time.Second
+
+// Backend wraps a service with runtime stats which
+// are needed by load balancers
+type Backend struct {
+	*baker.Service
+
+	// outstanding needs to be accessed atomically
+	outstanding int64
+
+	mux      sync.Mutex
+	latency  float64
+	lastSeen time.Time
+
+	// currentWeight is owned by weightedRoundRobin balancer
+	// and only be accessed while holding its lock
+	currentWeight int
+
+	// onChange will be called whenever backend's availability changes
+	onChange func()
+
+	// health, outlier and breaker are shared with the backend
+	// which replaces this one if their configs are unchanged
+	health  *healthState
+	outlier *outlierDetector
+	breaker *breaker
+}
+
+// healthState is the result of backend's active health check
+type healthState struct {
+	// unhealthy needs to be accessed atomically
+	unhealthy int32
+	cancel    context.CancelFunc
+}
+
+// Available returns true if backend can receive requests
+func (b *Backend) Available() bool {
+	if !b.Healthy() || b.Ejected() {
+		return false
+	}
+
+	return b.breaker == nil || b.breaker.current() != CircuitOpen
+}
+
+// Circuit returns state of backend's circuit breaker.
+// Backends without circuit breaker are always closed
+func (b *Backend) Circuit() CircuitState {
+	if b.breaker == nil {
+		return CircuitClosed
+	}
+
+	return b.breaker.current()
+}
+
+// Healthy returns false if active health check has marked backend as unhealthy
+func (b *Backend) Healthy() bool {
+	return b.health == nil || atomic.LoadInt32(&b.health.unhealthy) == 0
+}
+
+// Ejected returns true if outlier detection has ejected backend
+func (b *Backend) Ejected() bool {
+	return b.outlier != nil && b.outlier.isEjected()
+}
+
+// Outstanding returns number of requests which are sent to backend
+// and have not been completed yet
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+// Latency returns exponentially weighted moving average of backend's latency
+func (b *Backend) Latency() time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return time.Duration(b.latency)
+}
+
+// Weight returns backend's weight, default is 1
+func (b *Backend) Weight() int {
+	if b.Config == nil || b.Config.Weight <= 0 {
+		return 1
+	}
+
+	return b.Config.Weight
+}
+
+// Lease is a request which has been admitted by a backend.
+// Either Done or Release must be called once request is completed,
+// only the first call takes effect
+type Lease struct {
+	*Backend
+	// probe is non-zero if request is a half-open probe of backend's circuit breaker
+	probe uint64
+	// released needs to be accessed atomically
+	released int32
+}
+
+// Done releases the request and records its latency
+func (l *Lease) Done(elapsed time.Duration) {
+	if l.release() {
+		l.observe(elapsed)
+	}
+}
+
+// Release releases the request without recording its latency. It's used
+// for requests which have not been sent to backend
+func (l *Lease) Release() {
+	l.release()
+}
+
+// release returns false if lease has been already released
+func (l *Lease) release() bool {
+	if !atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		return false
+	}
+
+	atomic.AddInt64(&l.outstanding, -1)
+
+	if l.probe != 0 {
+		l.breaker.release(l.probe)
+	}
+
+	return true
+}
+
+// acquire reserves a request on backend. nil will be returned
+// if circuit breaker does not allow a new request
+func (b *Backend) acquire() *Lease {
+	pending := atomic.AddInt64(&b.outstanding, 1) - 1
+
+	lease := &Lease{Backend: b}
+	if b.breaker == nil {
+		return lease
+	}
+
+	ok, probe := b.breaker.allow(pending)
+	if !ok {
+		atomic.AddInt64(&b.outstanding, -1)
+		return nil
+	}
+
+	lease.probe = probe
+	return lease
+}
+
+// observe adds latency of a completed request to backend's ewma latency
+func (b *Backend) observe(elapsed time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+
+	if b.lastSeen.IsZero() {
+		b.latency = float64(elapsed)
+	} else {
+		// the longer backend has not been seen, the less
+		// old latency value matters
+		w := math.Exp(-float64(now.Sub(b.lastSeen)) / float64(ewmaDecay))
+		b.latency = b.latency*w + float64(elapsed)*(1-w)
+	}
+
+	b.lastSeen = now
+}
+
+// Report passes the result of a proxied request to backend's outlier detector
+// and circuit breaker. err is nil if request was successful
+func (b *Backend) Report(err error) {
+	changed := false
+
+	if b.outlier != nil {
+		if duration := b.outlier.record(err); duration > 0 {
+			changed = b.eject(duration, err)
+		}
+	}
+
+	if b.breaker != nil {
+		if state, ok := b.breaker.record(err); ok {
+			changed = b.trip(state, err) || changed
+		}
+	}
+
+	// onChange must be called without holding detector's or breaker's lock,
+	// services' lock is acquired by onChange and close is called while holding it
+	if changed {
+		b.onChange()
+	}
+}
+
+// trip handles circuit breaker's state changes. It returns false
+// if backend has been already removed
+func (b *Backend) trip(state CircuitState, err error) bool {
+	if state != CircuitOpen {
+		logger.Info("circuit of service %s is %s", b.Container.ID, state)
+		return true
+	}
+
+	scheduled := b.breaker.schedule(func() {
+		b.breaker.halfOpen()
+		logger.Info("circuit of service %s is %s", b.Container.ID, CircuitHalfOpen)
+		b.onChange()
+	})
+	if !scheduled {
+		return false
+	}
+
+	logger.Warn("circuit of service %s is open because %s", b.Container.ID, err)
+	return true
+}
+
+// eject makes backend unavailable for given duration. It returns false
+// if backend has been already removed
+func (b *Backend) eject(duration time.Duration, err error) bool {
+	// backend might have been removed while request was in progress
+	scheduled := b.outlier.schedule(duration, func() {
+		logger.Info("service %s is restored after ejection", b.Container.ID)
+		b.outlier.restore()
+		b.onChange()
+	})
+	if !scheduled {
+		return false
+	}
+
+	logger.Warn("service %s is ejected for %s because %s", b.Container.ID, duration, err)
+	return true
+}
+
+// healthURL returns the url which health check of service is sent to.
+// health check uses ping's path if path is not given
+func healthURL(service *baker.Service) string {
+	path := service.Config.HealthCheck.Path
+	if path == "" && service.Container.PingAddr != nil {
+		path = service.Container.PingAddr.Path()
+	}
+
+	return endpoint.NewHTTPAddr(service.Container.Addr, path).String()
+}
+
+// sameHealthCheck returns true if both services are checked the same way
+func sameHealthCheck(a, b *baker.Service) bool {
+	return reflect.DeepEqual(a.Config.HealthCheck, b.Config.HealthCheck) &&
+		healthURL(a) == healthURL(b) &&
+		a.Container.Addr.Secure() == b.Container.Addr.Secure() &&
+		reflect.DeepEqual(upstreamTLS(a), upstreamTLS(b))
+}
+
+// healthCheck starts active health checking of backend.
+// nil will be returned if checker can't be created
+func (b *Backend) healthCheck() *healthState {
+	config := b.Config.HealthCheck
+
+	transport, err := newTransport(b.Service)
+	if err != nil {
+		logger.Error("failed to start health check for service %s because %s", b.Container.ID, err)
+		return nil
+	}
+
+	state := &healthState{}
+
+	checker := health.New(&http.Client{Transport: transport}, healthURL(b.Service), health.Config{
+		Interval:           config.Interval.Duration(),
+		Timeout:            config.Timeout.Duration(),
+		ExpectedStatus:     config.ExpectedStatus,
+		ExpectedBody:       config.ExpectedBody,
+		HealthyThreshold:   config.HealthyThreshold,
+		UnhealthyThreshold: config.UnhealthyThreshold,
+	}, func(healthy bool, err error) {
+		if healthy {
+			logger.Info("service %s is healthy", b.Container.ID)
+			atomic.StoreInt32(&state.unhealthy, 0)
+		} else {
+			logger.Warn("service %s is unhealthy because %s", b.Container.ID, err)
+			atomic.StoreInt32(&state.unhealthy, 1)
+		}
+
+		b.onChange()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state.cancel = cancel
+
+	go func() {
+		checker.Run(ctx)
+		transport.CloseIdleConnections()
+	}()
+
+	return state
+}
+
+// close stops background processes of backend. next is the backend which replaces
+// this one and processes which are shared with it keep running. next is nil if
+// backend is removed
+func (b *Backend) close(next *Backend) {
+	if b.health != nil && (next == nil || next.health != b.health) {
+		b.health.cancel()
+	}
+
+	if b.outlier != nil && (next == nil || next.outlier != b.outlier) {
+		b.outlier.stop()
+	}
+
+	if b.breaker != nil && (next == nil || next.breaker != b.breaker) {
+		b.breaker.stop()
+	}
+}
+
+// newBackend creates a backend and starts its health check.
+// onChange will be called whenever backend's availability changes.
+// previous is the backend of the same container which is replaced by this one, its
+// latency and the state of each component whose config is unchanged are carried over.
+// previous can be nil
+func newBackend(service *baker.Service, onChange func(), previous *Backend) *Backend {
+	backend := &Backend{
+		Service:  service,
+		onChange: onChange,
+	}
+
+	if service.Config == nil {
+		return backend
+	}
+
+	if previous != nil {
+		previous.mux.Lock()
+		backend.latency = previous.latency
+		backend.lastSeen = previous.lastSeen
+		previous.mux.Unlock()
+	}
+
+	if config := service.Config.OutlierDetection; config != nil {
+		if previous != nil && previous.outlier != nil && reflect.DeepEqual(previous.Config.OutlierDetection, config) {
+			backend.outlier = previous.outlier
+		} else {
+			backend.outlier = newOutlierDetector(config)
+		}
+	}
+
+	if config := service.Config.CircuitBreaker; config != nil {
+		if previous != nil && previous.breaker != nil && reflect.DeepEqual(previous.Config.CircuitBreaker, config) {
+			backend.breaker = previous.breaker
+		} else {
+			backend.breaker = newBreaker(config)
+		}
+	}
+
+	if service.Config.HealthCheck != nil {
+		if previous != nil && previous.health != nil && sameHealthCheck(previous.Service, service) {
+			backend.health = previous.health
+		} else {
+			backend.health = backend.healthCheck()
+		}
+	}
+
+	return backend
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+// Balancer selects one backend among list of backends.
+// Select will be called concurrently and it never gets an empty list.
+type Balancer interface {
+	Select(backends []*Backend) *Backend
+}
+
+const (
+	RoundRobin         = "round_robin"
+	WeightedRoundRobin = "weighted_round_robin"
+	LeastConn          = "least_conn"
+	PowerOfTwoChoices  = "p2c"
+	EWMA               = "ewma"
+)
+
+// NewBalancer creates a balancer based on given config.
+// unknown types fall back to round robin
+func NewBalancer(config baker.LoadBalancer) Balancer {
+	switch config.Type {
+	case "", RoundRobin:
+		return &roundRobin{}
+	case WeightedRoundRobin:
+		return &weightedRoundRobin{}
+	case LeastConn:
+		return &leastConn{}
+	case PowerOfTwoChoices:
+		return &powerOfTwoChoices{}
+	case EWMA:
+		return &ewma{}
+	default:
+		logger.Warn("load balancer '%s' is not supported, round_robin will be used", config.Type)
+		return &roundRobin{}
+	}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (rr *roundRobin) Select(backends []*Backend) *Backend {
+	next := atomic.AddUint64(&rr.next, 1) - 1
+	return backends[next%uint64(len(backends))]
+}
+
+// weightedRoundRobin implements nginx's smooth weighted round robin
+type weightedRoundRobin struct {
+	mux sync.Mutex
+}
+
+func (wrr *weightedRoundRobin) Select(backends []*Backend) *Backend {
+	wrr.mux.Lock()
+	defer wrr.mux.Unlock()
+
+	var selected *Backend
+	total := 0
+
+	for _, backend := range backends {
+		weight := backend.Weight()
+		backend.currentWeight += weight
+		total += weight
+
+		if selected == nil || backend.currentWeight > selected.currentWeight {
+			selected = backend
+		}
+	}
+
+	selected.currentWeight -= total
+	return selected
+}
+
+// leastConn selects backend with the least outstanding requests.
+// ties are broken in round robin fashion
+type leastConn struct {
+	next uint64
+}
+
+func (lc *leastConn) Select(backends []*Backend) *Backend {
+	max := len(backends)
+	start := int(atomic.AddUint64(&lc.next, 1) % uint64(max))
+
+	selected := backends[start]
+	for i := 1; i < max; i++ {
+		backend := backends[(start+i)%max]
+		if backend.Outstanding() < selected.Outstanding() {
+			selected = backend
+		}
+	}
+
+	return selected
+}
+
+// pick2 picks two distinct random backends
+func pick2(backends []*Backend) (*Backend, *Backend) {
+	max := len(backends)
+	if max == 1 {
+		return backends[0], backends[0]
+	}
+
+	i := rand.Intn(max)
+	j := rand.Intn(max - 1)
+	if j >= i {
+		j++
+	}
+
+	return backends[i], backends[j]
+}
+
+// powerOfTwoChoices picks two random backends and selects
+// the one with less outstanding requests
+type powerOfTwoChoices struct{}
+
+func (p2c *powerOfTwoChoices) Select(backends []*Backend) *Backend {
+	a, b := pick2(backends)
+	if b.Outstanding() < a.Outstanding() {
+		return b
+	}
+
+	return a
+}
+
+// ewma picks two random backends and selects the one with lower
+// cost. cost is calculated by latency's moving average and outstanding requests
+type ewma struct{}
+
+func ewmaCost(backend *Backend) float64 {
+	return float64(backend.Latency()) * float64(backend.Outstanding()+1)
+}
+
+func (e *ewma) Select(backends []*Backend) *Backend {
+	a, b := pick2(backends)
+	if ewmaCost(b) < ewmaCost(a) {
+		return b
+	}
+
+	return a
+}
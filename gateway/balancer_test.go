@@ -0,0 +1,147 @@
+package gateway_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+func dummyServices(balancer string, weights ...int) *gateway.Services {
+	services := gateway.NewServices()
+
+	for i, weight := range weights {
+		service := dummyService(fmt.Sprintf("%d", i+1))
+		service.Config.LoadBalancer = baker.LoadBalancer{Type: balancer}
+		service.Config.Weight = weight
+		services.Add(service)
+	}
+
+	return services
+}
+
+func TestRoundRobin(t *testing.T) {
+	services := dummyServices(gateway.RoundRobin, 1, 1, 1)
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		backend := services.Get(nil)
+		counts[backend.Container.ID]++
+		backend.Done(time.Millisecond)
+	}
+
+	for id, count := range counts {
+		if count != 10 {
+			t.Fatalf("expected backend %s to be selected 10 times but got %d", id, count)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	services := dummyServices(gateway.WeightedRoundRobin, 5, 1, 1)
+
+	counts := make(map[string]int)
+	for i := 0; i < 70; i++ {
+		backend := services.Get(nil)
+		counts[backend.Container.ID]++
+		backend.Done(time.Millisecond)
+	}
+
+	expected := map[string]int{"1": 50, "2": 10, "3": 10}
+	for id, count := range expected {
+		if counts[id] != count {
+			t.Fatalf("expected backend %s to be selected %d times but got %d", id, count, counts[id])
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	services := dummyServices(gateway.LeastConn, 1, 1, 1)
+
+	// keep two requests open, the third backend must be selected next
+	first := services.Get(nil)
+	second := services.Get(nil)
+
+	third := services.Get(nil)
+	if third.Container.ID == first.Container.ID || third.Container.ID == second.Container.ID {
+		t.Fatalf("expected the idle backend to be selected but got %s", third.Container.ID)
+	}
+
+	first.Done(time.Millisecond)
+
+	next := services.Get(nil)
+	if next.Container.ID != first.Container.ID {
+		t.Fatalf("expected backend %s to be selected but got %s", first.Container.ID, next.Container.ID)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	services := dummyServices(gateway.PowerOfTwoChoices, 1, 1)
+
+	busy := services.Get(nil)
+	for i := 0; i < 20; i++ {
+		backend := services.Get(nil)
+		if backend.Container.ID == busy.Container.ID {
+			t.Fatal("expected backend with less outstanding requests to be selected")
+		}
+		backend.Done(time.Millisecond)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	services := dummyServices(gateway.EWMA, 1, 1)
+
+	// warm up both backends, backend 1 is much slower
+	seen := make(map[string]bool)
+	for len(seen) < 2 {
+		backend := services.Get(nil)
+		seen[backend.Container.ID] = true
+		if backend.Container.ID == "1" {
+			backend.Done(100 * time.Millisecond)
+		} else {
+			backend.Done(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		backend := services.Get(nil)
+		if backend.Container.ID != "2" {
+			t.Fatalf("expected faster backend to be selected but got %s", backend.Container.ID)
+		}
+		backend.Done(time.Millisecond)
+	}
+}
+
+func TestBalancersConcurrently(t *testing.T) {
+	balancers := []string{
+		gateway.RoundRobin,
+		gateway.WeightedRoundRobin,
+		gateway.LeastConn,
+		gateway.PowerOfTwoChoices,
+		gateway.EWMA,
+	}
+
+	for _, balancer := range balancers {
+		services := dummyServices(balancer, 1, 2, 3)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					backend := services.Get(nil)
+					if backend == nil {
+						t.Error("expected a backend to be selected")
+						return
+					}
+					backend.Done(time.Millisecond)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
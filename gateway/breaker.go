@@ -0,0 +1,259 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+)
+
+const (
+	defaultBreakerFailures    = 5
+	defaultBreakerMinRequests = 10
+	defaultBreakerInterval    = 10 * time.Second
+	defaultOpenTimeout        = 30 * time.Second
+	defaultHalfOpenRequests   = 1
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a closed/open/half-open circuit breaker
+type breaker struct {
+	mux sync.Mutex
+
+	consecutiveFailures int
+	failureRatio        float64
+	minRequests         int
+	interval            time.Duration
+	openTimeout         time.Duration
+	halfOpenRequests    int
+	maxPending          int64
+
+	state       CircuitState
+	consecutive int
+	total       int
+	failures    int
+	windowStart time.Time
+	// inflight and successes are only used in half-open state. epoch changes
+	// every time circuit becomes half-open, so probes of a previous one are ignored
+	inflight  int
+	successes int
+	epoch     uint64
+
+	// timer moves an open circuit to half-open, it's not
+	// scheduled anymore once breaker is stopped
+	timer   *time.Timer
+	stopped bool
+}
+
+// allow returns true if a request can be sent. pending is number of
+// requests which are already in-flight. probe is non-zero if request is
+// admitted as a half-open probe, and must be passed to release
+func (b *breaker) allow(pending int64) (ok bool, probe uint64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.maxPending > 0 && pending >= b.maxPending {
+		return false, 0
+	}
+
+	switch b.state {
+	case CircuitOpen:
+		return false, 0
+	case CircuitHalfOpen:
+		if b.inflight >= b.halfOpenRequests {
+			return false, 0
+		}
+		b.inflight++
+		return true, b.epoch
+	}
+
+	return true, 0
+}
+
+// release must be called for every probe once it's done.
+// probes of a previous half-open state are ignored
+func (b *breaker) release(probe uint64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.state == CircuitHalfOpen && probe == b.epoch && b.inflight > 0 {
+		b.inflight--
+	}
+}
+
+// record adds result of a request and returns the new state
+// and whether state has been changed
+func (b *breaker) record(err error) (CircuitState, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		return b.state, false
+
+	case CircuitHalfOpen:
+		if err != nil {
+			b.open()
+			return b.state, true
+		}
+
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			b.close()
+			return b.state, true
+		}
+
+		return b.state, false
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) >= b.interval {
+		b.windowStart = now
+		b.total = 0
+		b.failures = 0
+	}
+
+	b.total++
+
+	if err == nil {
+		b.consecutive = 0
+		return b.state, false
+	}
+
+	b.failures++
+	b.consecutive++
+
+	if b.consecutive >= b.consecutiveFailures {
+		b.open()
+		return b.state, true
+	}
+
+	if b.failureRatio > 0 && b.total >= b.minRequests && float64(b.failures)/float64(b.total) >= b.failureRatio {
+		b.open()
+		return b.state, true
+	}
+
+	return b.state, false
+}
+
+// halfOpen must be called once open timeout is passed
+func (b *breaker) halfOpen() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.state != CircuitOpen {
+		return
+	}
+
+	b.state = CircuitHalfOpen
+	b.epoch++
+	b.inflight = 0
+	b.successes = 0
+}
+
+// open trips the breaker
+// NOTE: caller must hold the lock
+func (b *breaker) open() {
+	b.state = CircuitOpen
+	b.consecutive = 0
+	b.total = 0
+	b.failures = 0
+}
+
+// close resets the breaker
+// NOTE: caller must hold the lock
+func (b *breaker) close() {
+	b.state = CircuitClosed
+	b.consecutive = 0
+	b.total = 0
+	b.failures = 0
+	b.windowStart = time.Now()
+}
+
+// schedule calls fn once open timeout is passed. It returns false
+// if breaker has been already stopped
+func (b *breaker) schedule(fn func()) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.stopped {
+		return false
+	}
+
+	b.timer = time.AfterFunc(b.openTimeout, fn)
+	return true
+}
+
+// stop cancels the scheduled half-open transition
+func (b *breaker) stop() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+func (b *breaker) current() CircuitState {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.state
+}
+
+func newBreaker(config *baker.CircuitBreaker) *breaker {
+	b := &breaker{
+		consecutiveFailures: config.ConsecutiveFailures,
+		failureRatio:        config.FailureRatio,
+		minRequests:         config.MinRequests,
+		interval:            config.Interval.Duration(),
+		openTimeout:         config.OpenTimeout.Duration(),
+		halfOpenRequests:    config.HalfOpenRequests,
+		maxPending:          int64(config.MaxPending),
+		windowStart:         time.Now(),
+	}
+
+	if b.consecutiveFailures <= 0 {
+		b.consecutiveFailures = defaultBreakerFailures
+	}
+
+	if b.minRequests <= 0 {
+		b.minRequests = defaultBreakerMinRequests
+	}
+
+	if b.interval <= 0 {
+		b.interval = defaultBreakerInterval
+	}
+
+	if b.openTimeout <= 0 {
+		b.openTimeout = defaultOpenTimeout
+	}
+
+	if b.halfOpenRequests <= 0 {
+		b.halfOpenRequests = defaultHalfOpenRequests
+	}
+
+	return b
+}
@@ -0,0 +1,191 @@
+package gateway_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	service := dummyUpstreamService(t, server, "1", baker.Rules{})
+	service.Config.CircuitBreaker = &baker.CircuitBreaker{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         baker.Duration(50 * time.Millisecond),
+	}
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+		return w
+	}
+
+	circuit := func() string {
+		return handler.Status()[0].Circuit
+	}
+
+	send()
+	send()
+
+	if circuit() != "open" {
+		t.Fatalf("expected circuit to be open but got %s", circuit())
+	}
+
+	w := send()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	if w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("expected problem response but got %s", w.Header().Get("Content-Type"))
+	}
+
+	atomic.StoreInt32(&failing, 0)
+
+	waitFor(t, time.Second, func() bool {
+		return circuit() == "half-open"
+	})
+
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", w.Code)
+	}
+
+	if circuit() != "closed" {
+		t.Fatalf("expected circuit to be closed but got %s", circuit())
+	}
+}
+
+func TestCircuitBreakerMaxPending(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	service := dummyUpstreamService(t, server, "1", baker.Rules{})
+	service.Config.CircuitBreaker = &baker.CircuitBreaker{
+		MaxPending: 1,
+	}
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+		done <- w.Code
+	}()
+
+	<-started
+
+	// second request must fail fast instead of waiting for the slow one
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	close(release)
+
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+}
+
+func TestCircuitBreakerProbes(t *testing.T) {
+	services := gateway.NewServices()
+
+	service := dummyService("1")
+	service.Config.CircuitBreaker = &baker.CircuitBreaker{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         baker.Duration(20 * time.Millisecond),
+		HalfOpenRequests:    1,
+	}
+	services.Add(service)
+
+	// admitted while circuit is closed and completed once it's half-open
+	stale := services.Get(nil)
+	stale.Report(errors.New("failed"))
+
+	waitFor(t, time.Second, func() bool {
+		return services.Backends()[0].Circuit() == gateway.CircuitHalfOpen
+	})
+
+	probe := services.Get(nil)
+	if probe == nil {
+		t.Fatal("expected a probe to be allowed")
+	}
+
+	// stale request must not free probe's slot
+	stale.Done(time.Millisecond)
+	if lease := services.Get(nil); lease != nil {
+		t.Fatal("expected only one probe to be allowed")
+	}
+
+	probe.Release()
+	if lease := services.Get(nil); lease == nil {
+		t.Fatal("expected a probe to be allowed once the previous one is released")
+	}
+}
+
+func TestCircuitBreakerCanceledProbe(t *testing.T) {
+	var failing int32 = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	service := dummyUpstreamService(t, server, "1", baker.Rules{})
+	service.Config.CircuitBreaker = &baker.CircuitBreaker{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         baker.Duration(20 * time.Millisecond),
+	}
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+	waitFor(t, time.Second, func() bool {
+		return handler.Status()[0].Circuit == "half-open"
+	})
+
+	atomic.StoreInt32(&failing, 0)
+
+	// a canceled probe is not a success
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil).WithContext(ctx))
+
+	if circuit := handler.Status()[0].Circuit; circuit != "half-open" {
+		t.Fatalf("expected circuit to stay half-open but got %s", circuit)
+	}
+}
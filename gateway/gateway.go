@@ -1,24 +1,27 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/pkg/acme"
-	"github.com/alinz/baker/pkg/endpoint"
 	"github.com/alinz/baker/pkg/json"
 	"github.com/alinz/baker/pkg/logger"
 	"github.com/alinz/baker/service"
 )
 
 type Handler struct {
-	domains *Domains
+	domains   *Domains
+	upstreams *Upstreams
 }
 
 var _ service.Consumer = (*Handler)(nil)
@@ -49,19 +52,37 @@ func (s *Handler) HostPolicy(ctx context.Context, host string) error {
 	return nil
 }
 
-// Service will be called by service.Producer
+// Service will be called by service.Producer once service has been changed
 // NOTE: do not call this directly
-func (s *Handler) Service(service *baker.Service) error {
-	if service.Config == nil || service.Config.Domain == "" {
+func (s *Handler) Service(service *baker.Service, change baker.Change) error {
+	if change == baker.ServiceRemoved || change == baker.ServiceErrored ||
+		service.Config == nil || service.Config.Domain == "" {
 		logger.Debug("service %s has been removed", service.Container.ID)
 
 		// service needs to be remove from list
 		s.domains.Remove(service)
+		s.upstreams.Remove(service.Container.ID)
 		return nil
 	}
 
-	logger.Debug("service %s has been added to domain '%s' and path %s", service.Container.ID, service.Config.Domain, service.Config.Path)
-	s.domains.Add(service)
+	// upstream needs to exist before the service is routed. If it can't be built,
+	// service is not routed, and an updated one stops using its previous route
+	err := s.upstreams.Update(service)
+	if err != nil {
+		logger.Error("failed to create upstream for service %s because %s", service.Container.ID, err)
+		s.domains.Remove(service)
+		s.upstreams.Remove(service.Container.ID)
+		return err
+	}
+
+	if change == baker.ServiceUpdated {
+		// updated service replaces the previous one in place, or moves it if its domain or path has been changed
+		logger.Debug("service %s has been updated to domain '%s' and path %s", service.Container.ID, service.Config.Domain, service.Config.Path)
+		s.domains.Update(service)
+	} else {
+		logger.Debug("service %s has been added to domain '%s' and path %s", service.Container.ID, service.Config.Domain, service.Config.Path)
+		s.domains.Add(service)
+	}
 
 	return nil
 }
@@ -87,12 +108,21 @@ func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	service := services.Get()
-	if service == nil {
-		json.ResponseAsError(w, http.StatusNotFound, errors.New("resource or service not found"))
+	service := services.Get(r)
+	if service == nil && services.CircuitOpen() {
+		json.ResponseAsProblem(w, http.StatusServiceUnavailable, "Circuit Open", errors.New("all instances of resource or service are failing"))
+		return
+	} else if service == nil {
+		json.ResponseAsError(w, http.StatusServiceUnavailable, errors.New("resource or service is unavailable"))
 		return
 	}
 
+	// requests which are rejected before reaching backend don't affect its latency.
+	// forward records latency of proxied ones, which makes this a no-op for them
+	defer func() {
+		service.Release()
+	}()
+
 	if !service.Config.IncludeWWW && hasWWW {
 		logger.Debug("service '%s%s' not supported www subdomain", service.Config.Domain, service.Config.Path)
 		logger.Debug("service configured include_www to %t and hasWWW is %t", service.Config.IncludeWWW, hasWWW)
@@ -110,51 +140,154 @@ func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	target, err := url.Parse(endpoint.NewHTTPAddr(service.Container.Addr, r.URL.Path).String())
-	if err != nil {
-		json.ResponseAsError(w, http.StatusInternalServerError, err)
-		return
+	retry := service.Config.Rules.Retry
+	if retry == nil {
+		retry = &baker.Retry{}
+	}
+
+	// request's body needs to be buffered, so it can be sent again
+	var body []byte
+	canRetry := retry.Attempts > 0
+	if canRetry {
+		services.budget.deposit()
+
+		maxBodySize := retry.MaxBodySize
+		if maxBodySize <= 0 {
+			maxBodySize = defaultMaxBodySize
+		}
+
+		var err error
+		body, canRetry, err = bufferBody(r, maxBodySize)
+		if err != nil {
+			json.ResponseAsError(w, http.StatusBadRequest, fmt.Errorf("failed to read request's body"))
+			return
+		}
+	}
+
+	tried := make([]*Backend, 0, 1)
+
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if attempt > 0 {
+			w.Header().Set(RetryCountHeader, strconv.Itoa(attempt))
+		}
+
+		services.Pin(w, r, service.Backend)
+
+		result := s.forward(w, r, service, retry.PerTryTimeout.Duration())
+		if result.err == nil || result.canceled {
+			return
+		}
+
+		tried = append(tried, service.Backend)
+
+		if !canRetry || attempt >= retry.Attempts || !retryable(r, result.err) || !services.budget.withdraw() {
+			respondWithFailure(w, result)
+			return
+		}
+
+		next := nextBackend(r, services, tried)
+		if next == nil {
+			respondWithFailure(w, result)
+			return
+		}
+
+		logger.Debug("retrying request %s%s on service %s", r.Host, r.URL, next.Container.ID)
+
+		service = next
+	}
+}
+
+// nextBackend selects a ready backend which has not been tried yet. tried will
+// be extended by backends which are not ready
+func nextBackend(r *http.Request, services *Services, tried []*Backend) *Lease {
+	for {
+		backend := services.Get(r, tried...)
+		if backend == nil {
+			return nil
+		}
+
+		if backend.Container.Active && backend.Config.Ready {
+			return backend
+		}
+
+		// backend has not received the request, so its latency is not affected
+		backend.Release()
+		tried = append(tried, backend.Backend)
+	}
+}
+
+// forward proxies request to leased backend once, reports the outcome to backend and
+// completes the lease. if timeout is set, upstream needs to respond within it
+func (s *Handler) forward(w http.ResponseWriter, r *http.Request, lease *Lease, timeout time.Duration) *outcome {
+	result := &outcome{}
+	backend := lease.Backend
+
+	// lease is released without latency if request doesn't reach backend, is canceled,
+	// or reverse proxy panics once client goes away while response is copied
+	defer lease.Release()
+
+	proxy := s.upstreams.Get(backend.Container.ID)
+	if proxy == nil {
+		result.err = errUnreachable
+		return result
 	}
 
-	logger.Debug("proxied %s%s -> %s", r.Host, r.URL, target)
+	logger.Debug("proxied %s%s -> %s", r.Host, r.URL, backend.Container.Addr)
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
 
-	// Collect all directors as one wrapped one
-	director := func(r *http.Request) {}
-	for _, requestUpdater := range service.Config.Rules.RequestUpdaters {
-		director = requestUpdater.Director(director)
+		// timer only covers the time until response's headers are received
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&result.timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+
+		result.onResponse = func() {
+			timer.Stop()
+		}
 	}
 
-	originalDirector := proxy.Director
-	proxy.Director = func(r *http.Request) {
-		logger.Debug("Original Request URL: %s", r.URL)
-		// Need to clear URL.Path to empty as target is already known
-		// Also, NewSingleHostReverseProxy.Director's default
-		// will try to merge target.Path and r.URL.Path
-		r.URL.Path = ""
-		// originalDirector needs to be called first before calling other directors
-		originalDirector(r)
-		logger.Debug("Request URL after applying default director: %s", r.URL)
+	start := time.Now()
+	proxy.ServeHTTP(w, withOutcome(r.WithContext(ctx), result))
+	elapsed := time.Since(start)
 
-		// for some reasons, original director inside NewSingleHostReverseProxy add extra /
-		// there is no point to have that so in this section, we are removing it
-		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
+	result.canceled = r.Context().Err() != nil
+	if result.err != nil && atomic.LoadInt32(&result.timedOut) == 1 {
+		result.err = errPerTryTimeout
+	}
 
-		director(r)
-		logger.Debug("Request URL after applying all directors: %s", r.URL)
+	// requests canceled by clients say nothing about upstream's health,
+	// so they are neither a failure nor a success
+	if !result.canceled {
+		backend.Report(result.failure())
+		lease.Done(elapsed)
 	}
 
-	if service.Container.Addr.Secure() {
-		panic("not implemented yet")
-		// proxy.Transport = nil
+	return result
+}
+
+// respondWithFailure writes an error based on the last outcome
+func respondWithFailure(w http.ResponseWriter, result *outcome) {
+	if result.err == errPerTryTimeout {
+		json.ResponseAsError(w, http.StatusGatewayTimeout, result.err)
+		return
 	}
 
-	proxy.ServeHTTP(w, r)
+	json.ResponseAsError(w, http.StatusBadGateway, errUnreachable)
 }
 
 func NewHandler() *Handler {
 	return &Handler{
-		domains: NewDomains(),
+		domains:   NewDomains(),
+		upstreams: NewUpstreams(),
 	}
 }
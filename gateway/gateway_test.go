@@ -0,0 +1,418 @@
+package gateway_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/rule"
+)
+
+func serverAddr(t *testing.T, server *httptest.Server, secure bool) endpoint.Addr {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return endpoint.NewAddr(host, p, secure)
+}
+
+func writeCA(t *testing.T, server *httptest.Server) (string, func()) {
+	dir, err := ioutil.TempDir("", "baker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := path.Join(dir, "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	err = ioutil.WriteFile(caFile, pemData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return caFile, func() { os.RemoveAll(dir) }
+}
+
+func TestSecureUpstream(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer upstream.Close()
+
+	caFile, cleanup := writeCA(t, upstream)
+	defer cleanup()
+
+	// container's tls comes from labels and config's tls is returned by service itself
+	testCases := []struct {
+		name      string
+		container *baker.TLS
+		config    *baker.TLS
+		expected  int
+	}{
+		{
+			name:     "system roots",
+			expected: http.StatusBadGateway,
+		},
+		{
+			name:      "ca bundle",
+			container: &baker.TLS{CA: caFile},
+			expected:  http.StatusOK,
+		},
+		{
+			name:      "ca bundle with sni",
+			container: &baker.TLS{CA: caFile, ServerName: "example.com"},
+			expected:  http.StatusOK,
+		},
+		{
+			name:      "ca bundle with wrong sni",
+			container: &baker.TLS{CA: caFile, ServerName: "wrong.com"},
+			expected:  http.StatusBadGateway,
+		},
+		{
+			// service is not routed if its upstream can't be created
+			name:      "missing ca bundle",
+			container: &baker.TLS{CA: caFile + ".missing"},
+			expected:  http.StatusNotFound,
+		},
+		{
+			name:      "sni from config",
+			container: &baker.TLS{CA: caFile, ServerName: "wrong.com"},
+			config:    &baker.TLS{ServerName: "example.com"},
+			expected:  http.StatusOK,
+		},
+		{
+			name:     "ca bundle from config is ignored",
+			config:   &baker.TLS{CA: caFile},
+			expected: http.StatusBadGateway,
+		},
+		{
+			name:     "insecure from config is ignored",
+			config:   &baker.TLS{InsecureSkipVerify: true},
+			expected: http.StatusBadGateway,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			addr := serverAddr(t, upstream, true)
+
+			handler := gateway.NewHandler()
+			handler.Service(&baker.Service{
+				Container: &baker.Container{
+					ID:       "1",
+					Active:   true,
+					Addr:     addr,
+					PingAddr: endpoint.NewHTTPAddr(addr, "/config"),
+					TLS:      testCase.container,
+				},
+				Config: &baker.Config{
+					Domain: "example.com",
+					Path:   "/secure",
+					Ready:  true,
+					TLS:    testCase.config,
+				},
+			}, baker.ServiceAdded)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/secure", nil))
+
+			if w.Code != testCase.expected {
+				t.Fatalf("expected status %d but got %d", testCase.expected, w.Code)
+			}
+		})
+	}
+}
+
+func dummyUpstreamService(t testing.TB, server *httptest.Server, id string, rules baker.Rules) *baker.Service {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := endpoint.NewAddr(host, p, false)
+
+	return &baker.Service{
+		Container: &baker.Container{
+			ID:       id,
+			Active:   true,
+			Addr:     addr,
+			PingAddr: endpoint.NewHTTPAddr(addr, "/config"),
+		},
+		Config: &baker.Config{
+			Domain: "example.com",
+			Path:   "/service1*",
+			Ready:  true,
+			Rules:  rules,
+		},
+	}
+}
+
+func TestUpstreamPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+
+	testCases := []struct {
+		url      string
+		rules    baker.Rules
+		expected string
+	}{
+		{
+			url:      "http://example.com/service1/hello?a=1",
+			expected: "/service1/hello?a=1",
+		},
+		{
+			url:      "http://example.com/service1/hello/?a=1",
+			expected: "/service1/hello?a=1",
+		},
+		{
+			url: "http://example.com/service1/hello?a=1",
+			rules: baker.Rules{
+				RequestUpdaters: rule.RequestUpdaters{
+					&rule.ReplacePath{Search: "/service1", Replace: "", Times: -1},
+				},
+			},
+			expected: "/hello?a=1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		handler := gateway.NewHandler()
+		handler.Service(dummyUpstreamService(t, upstream, "1", testCase.rules), baker.ServiceAdded)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testCase.url, nil))
+
+		if w.Body.String() != testCase.expected {
+			t.Fatalf("expected upstream to receive '%s' but got '%s'", testCase.expected, w.Body.String())
+		}
+	}
+}
+
+func TestServiceChanges(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	handler := gateway.NewHandler()
+
+	status := func(url string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code
+	}
+
+	service := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	handler.Service(service, baker.ServiceAdded)
+
+	if code := status("http://example.com/service1/hello"); code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+
+	// updated service moves to its new path
+	updated := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	updated.Config.Path = "/service2*"
+	handler.Service(updated, baker.ServiceUpdated)
+
+	if code := status("http://example.com/service1/hello"); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 but got %d", code)
+	}
+
+	if code := status("http://example.com/service2/hello"); code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+
+	// updated service whose upstream can't be created is not routed anymore
+	broken := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	broken.Container.Addr = endpoint.NewAddr("127.0.0.1", 443, true)
+	broken.Container.TLS = &baker.TLS{CA: "missing.pem"}
+	if err := handler.Service(broken, baker.ServiceUpdated); err == nil {
+		t.Fatal("expected upstream to fail")
+	}
+
+	if code := status("http://example.com/service2/hello"); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 but got %d", code)
+	}
+
+	handler.Service(updated, baker.ServiceAdded)
+
+	// errored service is not routed anymore
+	handler.Service(&baker.Service{Container: updated.Container, Err: errors.New("ping failed")}, baker.ServiceErrored)
+
+	if code := status("http://example.com/service2/hello"); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 but got %d", code)
+	}
+}
+
+func TestRejectedRequestLatency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	service := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	service.Config.Ready = false
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+	if w.Code != http.StatusTooEarly {
+		t.Fatalf("expected status %d but got %d", http.StatusTooEarly, w.Code)
+	}
+
+	// request has not reached backend, so its latency is not recorded
+	status := handler.Status()[0]
+	if status.Outstanding != 0 || status.LatencyMS != 0 {
+		t.Fatalf("expected no outstanding request and latency but got %+v", status)
+	}
+
+	ready := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	handler.Service(ready, baker.ServiceUpdated)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+	if status := handler.Status()[0]; status.Outstanding != 0 || status.LatencyMS < 10 {
+		t.Fatalf("expected latency of proxied request to be recorded but got %+v", status)
+	}
+}
+
+func TestUpstreamRebuild(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	upstreams := gateway.NewUpstreams()
+
+	service := dummyUpstreamService(t, upstream, "1", baker.Rules{})
+	upstreams.Update(service)
+	proxy1 := upstreams.Get("1")
+
+	// same service needs to reuse the same proxy
+	upstreams.Update(dummyUpstreamService(t, upstream, "1", baker.Rules{}))
+	if upstreams.Get("1") != proxy1 {
+		t.Fatal("expected proxy to be reused")
+	}
+
+	// changing rules needs to rebuild the proxy
+	upstreams.Update(dummyUpstreamService(t, upstream, "1", baker.Rules{
+		RequestUpdaters: rule.RequestUpdaters{
+			&rule.ReplacePath{Search: "/service1", Replace: "", Times: -1},
+		},
+	}))
+	if upstreams.Get("1") == proxy1 {
+		t.Fatal("expected proxy to be rebuilt")
+	}
+
+	upstreams.Remove("1")
+	if upstreams.Get("1") != nil {
+		t.Fatal("expected proxy to be removed")
+	}
+}
+
+// newCountingServer creates an upstream which counts every new connection,
+// this is used to report connection churn in benchmarks
+func newCountingServer() (*httptest.Server, *int64) {
+	var conns int64
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+
+	return server, &conns
+}
+
+func BenchmarkHandler(b *testing.B) {
+	upstream, conns := newCountingServer()
+	defer upstream.Close()
+
+	handler := gateway.NewHandler()
+	handler.Service(dummyUpstreamService(b, upstream, "1", baker.Rules{}), baker.ServiceAdded)
+
+	// high parallelism exposes connection churn when
+	// idle connections are not pooled enough
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("expected status 200 but got %d", w.Code)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+}
+
+// BenchmarkProxyPerRequest is the baseline for BenchmarkHandler, it creates a new reverse proxy
+// on each request with the default transport
+func BenchmarkProxyPerRequest(b *testing.B) {
+	upstream, conns := newCountingServer()
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// high parallelism exposes connection churn when
+	// idle connections are not pooled enough
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("expected status 200 but got %d", w.Code)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+}
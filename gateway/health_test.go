@@ -0,0 +1,83 @@
+package gateway_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+// waitFor calls fn until it returns true or timeout is reached
+func waitFor(t *testing.T, timeout time.Duration, fn func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy int32 = 1
+
+	unstable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer unstable.Close()
+
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer stable.Close()
+
+	healthCheck := &baker.HealthCheck{
+		Path:               "/health",
+		Interval:           baker.Duration(10 * time.Millisecond),
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+
+	services := gateway.NewServices()
+	for i, server := range []*httptest.Server{unstable, stable} {
+		service := dummyUpstreamService(t, server, []string{"unstable", "stable"}[i], baker.Rules{})
+		service.Config.HealthCheck = healthCheck
+		services.Add(service)
+	}
+	defer services.Remove(dummyService("unstable"))
+	defer services.Remove(dummyService("stable"))
+
+	selected := func() map[string]bool {
+		ids := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			backend := services.Get(nil)
+			ids[backend.Container.ID] = true
+			backend.Done(time.Millisecond)
+		}
+		return ids
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(t, time.Second, func() bool {
+		ids := selected()
+		return len(ids) == 1 && ids["stable"]
+	})
+
+	// route must still be there
+	if services.Len() != 2 {
+		t.Fatalf("expected unhealthy backend to stay in services but got %d backends", services.Len())
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(t, time.Second, func() bool {
+		return len(selected()) == 2
+	})
+}
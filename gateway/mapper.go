@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"net/http"
 	"sync"
 
 	"github.com/alinz/baker"
@@ -8,62 +9,267 @@ import (
 )
 
 // Services contains collection of same services
-// it also implements basic round robin getter
+// it uses a Balancer to pick one of them and an optional
+// Affinity to pin clients to one of them
 type Services struct {
-	mux     sync.RWMutex
-	store   []*baker.Service
-	current int
+	mux            sync.RWMutex
+	store          []*Backend
+	available      []*Backend
+	balancer       Balancer
+	balancerType   string
+	affinity       Affinity
+	affinityConfig *baker.Affinity
+	budget         *retryBudget
+	// maxEjectionPercent is the max percent of backends which can be ejected at the same time
+	maxEjectionPercent int
 }
 
-// Get implements basic round robin
-func (s *Services) Get() *baker.Service {
+// Get selects an available backend. If request is pinned to a backend, that backend is returned
+// otherwise services' balancer is used. r can be nil, which ignores affinity.
+// excluded backends are never selected, this is used to retry on a different backend.
+// nil will be returned if there is no available backend.
+// Lease's Done or Release method must be called once request is completed
+func (s *Services) Get(r *http.Request, excluded ...*Backend) *Lease {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 
-	max := len(s.store)
-	if max == 0 {
-		return nil
+	available := s.available
+	if len(excluded) > 0 {
+		available = exclude(available, excluded)
+	}
+
+	if s.affinity != nil && r != nil {
+		backend := s.affinity.Lookup(r)
+		if backend != nil && !contains(excluded, backend) {
+			if lease := backend.acquire(); lease != nil {
+				return lease
+			}
+		}
+	}
+
+	// backends which are rejected by their circuit breakers
+	// are excluded and another one gets selected
+	for len(available) > 0 {
+		backend := s.balancer.Select(available)
+		if lease := backend.acquire(); lease != nil {
+			return lease
+		}
+
+		available = exclude(available, []*Backend{backend})
+	}
+
+	return nil
+}
+
+// CircuitOpen returns true if circuits of all backends are either open or half-open
+func (s *Services) CircuitOpen() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if len(s.store) == 0 {
+		return false
 	}
 
-	if s.current >= max {
-		s.current = 0
+	for _, backend := range s.store {
+		if backend.Circuit() == CircuitClosed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Backends returns a snapshot of all backends, including unavailable ones
+func (s *Services) Backends() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	backends := make([]*Backend, len(s.store))
+	copy(backends, s.store)
+	return backends
+}
+
+// Pin makes sure the next requests of the same client reach the same backend.
+// it does nothing if services has no affinity
+func (s *Services) Pin(w http.ResponseWriter, r *http.Request, backend *Backend) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if s.affinity == nil {
+		return
+	}
+
+	s.affinity.Pin(w, r, backend)
+}
+
+func contains(backends []*Backend, backend *Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exclude returns a new list of backends without excluded ones
+func exclude(backends []*Backend, excluded []*Backend) []*Backend {
+	result := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if !contains(excluded, backend) {
+			result = append(result, backend)
+		}
 	}
 
-	result := s.store[s.current]
-	s.current++
 	return result
 }
 
+// refresh rebuilds list of available backends
+// NOTE: caller must hold the write lock
+func (s *Services) refresh() {
+	available := make([]*Backend, 0, len(s.store))
+	ejected := make([]*Backend, 0)
+
+	for _, backend := range s.store {
+		switch {
+		case backend.Available():
+			available = append(available, backend)
+		case backend.Ejected() && backend.Healthy() && backend.Circuit() != CircuitOpen:
+			ejected = append(ejected, backend)
+		}
+	}
+
+	// outlier detection can't make more than max ejection percent of
+	// backends unavailable, so the rest of ejected ones are still used
+	maxEjectionPercent := s.maxEjectionPercent
+	if maxEjectionPercent <= 0 {
+		maxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	if limit := len(s.store) * maxEjectionPercent / 100; len(ejected) > limit {
+		available = append(available, ejected[limit:]...)
+	}
+
+	s.available = available
+
+	if s.affinity != nil {
+		s.affinity.Update(s.available)
+	}
+}
+
+// update will be called by backends once their availability changes
+func (s *Services) update() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.refresh()
+}
+
+func sameAffinity(a, b *baker.Affinity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// Len returns number of backends in pool
+func (s *Services) Len() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return len(s.store)
+}
+
 // Add a service to pool
+// the last added service decides which balancer and affinity are used
 func (s *Services) Add(service *baker.Service) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	// need to make sure not adding multiple same id container
-	for _, s := range s.store {
-		if s.Container.ID == service.Container.ID {
+	for _, backend := range s.store {
+		if backend.Container.ID == service.Container.ID {
 			return
 		}
 	}
-	s.store = append(s.store, service)
+
+	s.configure(service)
+
+	backend := newBackend(service, s.update, nil)
+
+	s.store = append(s.store, backend)
+	s.refresh()
+}
+
+// Update replaces the backend of the same container in place, so requests never see the pool
+// without it. Health check, outlier detection and circuit breaker states are carried over if their
+// configs are unchanged. Service is added if it's not in pool
+func (s *Services) Update(service *baker.Service) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.configure(service)
+
+	for i, previous := range s.store {
+		if previous.Container.ID == service.Container.ID {
+			backend := newBackend(service, s.update, previous)
+			s.store[i] = backend
+			previous.close(backend)
+			s.refresh()
+			return
+		}
+	}
+
+	s.store = append(s.store, newBackend(service, s.update, nil))
+	s.refresh()
+}
+
+// configure updates balancer, affinity and retry budget based on service's config
+// NOTE: caller must hold the write lock
+func (s *Services) configure(service *baker.Service) {
+	if service.Config != nil && service.Config.LoadBalancer.Type != s.balancerType {
+		s.balancerType = service.Config.LoadBalancer.Type
+		s.balancer = NewBalancer(service.Config.LoadBalancer)
+	}
+
+	if service.Config != nil && !sameAffinity(service.Config.Affinity, s.affinityConfig) {
+		s.affinityConfig = service.Config.Affinity
+		s.affinity = NewAffinity(service.Config.Affinity)
+	}
+
+	if service.Config != nil && service.Config.Rules.Retry != nil {
+		s.budget.setRatio(service.Config.Rules.Retry.Budget)
+	}
+
+	if service.Config != nil && service.Config.OutlierDetection != nil {
+		s.maxEjectionPercent = service.Config.OutlierDetection.MaxEjectionPercent
+	}
 }
 
 // Remove a service from pool
 func (s *Services) Remove(service *baker.Service) {
 	s.mux.Lock()
-	for i, serv := range s.store {
-		if serv.Container.ID == service.Container.ID {
+	defer s.mux.Unlock()
+
+	for i, backend := range s.store {
+		if backend.Container.ID == service.Container.ID {
 			// remove item from store using index
 			s.store = append(s.store[:i], s.store[i+1:]...)
+			backend.close(nil)
 			break
 		}
 	}
-	s.mux.Unlock()
+
+	s.refresh()
 }
 
 // NewServices creates services object
 func NewServices() *Services {
 	return &Services{
-		store: make([]*baker.Service, 0),
+		store:     make([]*Backend, 0),
+		available: make([]*Backend, 0),
+		balancer:  NewBalancer(baker.LoadBalancer{}),
+		budget:    newRetryBudget(),
 	}
 }
 
@@ -110,6 +316,39 @@ func (p *Paths) Add(service *baker.Service) {
 	services.(*Services).Add(service)
 }
 
+// Update replaces the service in place if its path is unchanged. Otherwise, service
+// is added to its new path before it's removed from the previous one
+func (p *Paths) Update(service *baker.Service) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	cached, ok := p.id2Service[service.Container.ID]
+
+	// services without path are not routed anymore
+	if service.Config == nil || service.Config.Path == "" {
+		if ok {
+			delete(p.id2Service, service.Container.ID)
+			p.remove(cached)
+		}
+		return
+	}
+
+	key := []byte(service.Config.Path)
+
+	services, err := p.store.Search(key)
+	if err == trie.ErrNotFound {
+		services = NewServices()
+		p.store.Insert(key, services)
+	}
+
+	p.id2Service[service.Container.ID] = service
+	services.(*Services).Update(service)
+
+	if ok && cached.Config.Path != service.Config.Path {
+		p.remove(cached)
+	}
+}
+
 // Remove service from paths
 // service might have not have path. in order to find the service
 // Paths uses second id2Service to locate it and pass that
@@ -125,8 +364,13 @@ func (p *Paths) Remove(service *baker.Service) {
 	}
 
 	delete(p.id2Service, service.Container.ID)
+	p.remove(cached)
+}
 
-	key := []byte(cached.Config.Path)
+// remove service from services of its path
+// NOTE: caller must hold the write lock
+func (p *Paths) remove(service *baker.Service) {
+	key := []byte(service.Config.Path)
 
 	value, err := p.store.Search(key)
 	if err != nil {
@@ -134,13 +378,38 @@ func (p *Paths) Remove(service *baker.Service) {
 	}
 
 	services := value.(*Services)
-	services.Remove(cached)
+	services.Remove(service)
 
-	if len(services.store) == 0 {
+	if services.Len() == 0 {
 		p.store.Remove(key)
 	}
 }
 
+// Backends returns a snapshot of all backends of all paths
+func (p *Paths) Backends() []*Backend {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	backends := make([]*Backend, 0, len(p.id2Service))
+	seen := make(map[string]bool)
+
+	for _, service := range p.id2Service {
+		if seen[service.Config.Path] {
+			continue
+		}
+		seen[service.Config.Path] = true
+
+		value, err := p.store.Search([]byte(service.Config.Path))
+		if err != nil {
+			continue
+		}
+
+		backends = append(backends, value.(*Services).Backends()...)
+	}
+
+	return backends
+}
+
 // NewPaths create Paths object
 func NewPaths() *Paths {
 	return &Paths{
@@ -189,6 +458,33 @@ func (d *Domains) Add(service *baker.Service) {
 	paths.Add(service)
 }
 
+// Update replaces the service in place if its domain and path are unchanged. Otherwise,
+// service is added to its new domain and path before it's removed from the previous ones
+func (d *Domains) Update(service *baker.Service) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	// ignore any services that don't have config or empty domain
+	if service.Config == nil || service.Config.Domain == "" {
+		return
+	}
+
+	paths, ok := d.store[service.Config.Domain]
+	if !ok {
+		paths = NewPaths()
+		d.store[service.Config.Domain] = paths
+	}
+
+	cached, ok := d.id2Service[service.Container.ID]
+
+	d.id2Service[service.Container.ID] = service
+	paths.Update(service)
+
+	if ok && cached.Config.Domain != service.Config.Domain {
+		d.store[cached.Config.Domain].Remove(cached)
+	}
+}
+
 // Remove a service from pool of same domain
 func (d *Domains) Remove(service *baker.Service) {
 	d.mux.Lock()
@@ -211,6 +507,19 @@ func (d *Domains) Remove(service *baker.Service) {
 	paths.Remove(cached)
 }
 
+// Backends returns a snapshot of all backends of all domains
+func (d *Domains) Backends() []*Backend {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	backends := make([]*Backend, 0, len(d.id2Service))
+	for _, paths := range d.store {
+		backends = append(backends, paths.Backends()...)
+	}
+
+	return backends
+}
+
 // NewDomains creates a Domains object
 func NewDomains() *Domains {
 	return &Domains{
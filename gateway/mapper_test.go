@@ -1,8 +1,10 @@
 package gateway_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/gateway"
@@ -27,8 +29,6 @@ func dummyService(id string) *baker.Service {
 }
 
 func TestServices(t *testing.T) {
-	t.Skip()
-
 	services := gateway.NewServices()
 
 	service := dummyService("1")
@@ -37,30 +37,30 @@ func TestServices(t *testing.T) {
 	service = dummyService("2")
 	services.Add(service)
 
-	service1 := services.Get()
+	service1 := services.Get(nil)
 	if service1 == nil {
 		t.Fatal("service should be presented")
 	}
 
-	service2 := services.Get()
+	service2 := services.Get(nil)
 	if service1.Container.ID == service2.Container.ID {
 		t.Fatal("services should be different")
 	}
 
 	services.Remove(service)
-	service = services.Get()
-	if service == nil {
-		t.Fatal("service should not be presented")
+	backend := services.Get(nil)
+	if backend == nil {
+		t.Fatal("service should be presented")
 	}
 
-	service = services.Get()
-	if service == nil {
-		t.Fatal("service should not be presented")
+	backend = services.Get(nil)
+	if backend == nil {
+		t.Fatal("service should be presented")
 	}
 
-	services.Remove(service)
-	service = services.Get()
-	if service != nil {
+	services.Remove(backend.Service)
+	backend = services.Get(nil)
+	if backend != nil {
 		t.Fatal("service should not be presented")
 	}
 }
@@ -97,3 +97,103 @@ func TestDomains(t *testing.T) {
 
 	fmt.Printf("%v", domains)
 }
+
+func TestDomainsMultipleEndpoints(t *testing.T) {
+	domains := gateway.NewDomains()
+
+	// both endpoints belong to the same container
+	api := dummyService("1/api")
+	api.Config.Domain = "api.example.com"
+
+	admin := dummyService("1/admin")
+	admin.Config.Domain = "admin.example.com"
+
+	domains.Add(api)
+	domains.Add(admin)
+
+	if len(domains.Backends()) != 2 {
+		t.Fatalf("expected 2 backends but got %d", len(domains.Backends()))
+	}
+
+	domains.Remove(api)
+
+	if services := domains.Paths("api.example.com").Services("/test"); services != nil {
+		t.Fatal("api endpoint should be removed")
+	}
+
+	services := domains.Paths("admin.example.com").Services("/test")
+	if services == nil || services.Len() != 1 {
+		t.Fatal("admin endpoint should not be removed")
+	}
+}
+
+func TestServicesUpdate(t *testing.T) {
+	services := gateway.NewServices()
+
+	breaker := &baker.CircuitBreaker{ConsecutiveFailures: 1, OpenTimeout: baker.Duration(time.Minute)}
+
+	service := dummyService("1")
+	service.Config.CircuitBreaker = breaker
+	services.Add(service)
+
+	lease := services.Get(nil)
+	lease.Report(errors.New("failed"))
+	lease.Done(time.Millisecond)
+
+	// unchanged circuit breaker keeps its state
+	updated := dummyService("1")
+	updated.Config.CircuitBreaker = breaker
+	updated.Config.Weight = 2
+	services.Update(updated)
+
+	backends := services.Backends()
+	if len(backends) != 1 || backends[0].Service != updated {
+		t.Fatal("expected backend to be replaced")
+	}
+
+	if backends[0].Circuit() != gateway.CircuitOpen {
+		t.Fatalf("expected circuit to stay open but got %s", backends[0].Circuit())
+	}
+
+	// changed circuit breaker starts from scratch
+	updated = dummyService("1")
+	updated.Config.CircuitBreaker = &baker.CircuitBreaker{ConsecutiveFailures: 2}
+	services.Update(updated)
+
+	if circuit := services.Backends()[0].Circuit(); circuit != gateway.CircuitClosed {
+		t.Fatalf("expected circuit to be closed but got %s", circuit)
+	}
+}
+
+func TestDomainsUpdate(t *testing.T) {
+	domains := gateway.NewDomains()
+
+	domains.Add(dummyService("1"))
+
+	// moved service is routed to its new path only
+	moved := dummyService("1")
+	moved.Config.Path = "/moved"
+	domains.Update(moved)
+
+	paths := domains.Paths("example.com")
+	if services := paths.Services("/test"); services != nil {
+		t.Fatal("previous path should be removed")
+	}
+
+	if services := paths.Services("/moved"); services == nil || services.Len() != 1 {
+		t.Fatal("service should be moved to its new path")
+	}
+
+	// service is moved to its new domain
+	moved = dummyService("1")
+	moved.Config.Domain = "api.example.com"
+	domains.Update(moved)
+
+	if services := paths.Services("/moved"); services != nil {
+		t.Fatal("previous domain should be removed")
+	}
+
+	if services := domains.Paths("api.example.com").Services("/test"); services == nil || services.Len() != 1 {
+		t.Fatal("service should be moved to its new domain")
+	}
+}
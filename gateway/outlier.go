@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alinz/baker"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultMinRequests         = 10
+	defaultOutlierInterval     = 10 * time.Second
+	defaultBaseEjection        = 30 * time.Second
+	defaultMaxEjection         = 5 * time.Minute
+	defaultMaxEjectionPercent  = 50
+)
+
+// outlierDetector keeps track of proxied traffic's results of a backend
+// and decides when backend needs to be ejected
+type outlierDetector struct {
+	mux sync.Mutex
+
+	consecutiveFailures int
+	errorRate           float64
+	minRequests         int
+	interval            time.Duration
+	baseEjection        time.Duration
+	maxEjection         time.Duration
+
+	consecutive int
+	total       int
+	failures    int
+	windowStart time.Time
+	ejections   int
+	ejected     bool
+
+	// timer restores an ejected backend, it's not
+	// scheduled anymore once detector is stopped
+	timer   *time.Timer
+	stopped bool
+}
+
+// record adds result of a request. A positive duration will be returned
+// if backend needs to be ejected for that long
+func (o *outlierDetector) record(err error) time.Duration {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if o.ejected {
+		return 0
+	}
+
+	now := time.Now()
+	if now.Sub(o.windowStart) >= o.interval {
+		// a whole window without ejection makes the next ejection shorter
+		if o.total > 0 && o.ejections > 0 {
+			o.ejections--
+		}
+
+		o.windowStart = now
+		o.total = 0
+		o.failures = 0
+	}
+
+	o.total++
+
+	if err == nil {
+		o.consecutive = 0
+		return 0
+	}
+
+	o.failures++
+	o.consecutive++
+
+	if o.consecutive >= o.consecutiveFailures {
+		return o.eject(now)
+	}
+
+	if o.errorRate > 0 && o.total >= o.minRequests && float64(o.failures)/float64(o.total) >= o.errorRate {
+		return o.eject(now)
+	}
+
+	return 0
+}
+
+// eject returns ejection's duration which is doubled by each consecutive ejection
+// NOTE: caller must hold the lock
+func (o *outlierDetector) eject(now time.Time) time.Duration {
+	duration := o.baseEjection
+	for i := 0; i < o.ejections && duration < o.maxEjection; i++ {
+		duration *= 2
+	}
+
+	if duration > o.maxEjection {
+		duration = o.maxEjection
+	}
+
+	o.ejections++
+	o.ejected = true
+	o.consecutive = 0
+	o.total = 0
+	o.failures = 0
+	o.windowStart = now
+
+	return duration
+}
+
+// restore must be called once ejection's duration is passed
+func (o *outlierDetector) restore() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.ejected = false
+	o.windowStart = time.Now()
+}
+
+// schedule calls fn once ejection's duration is passed. It returns false
+// if detector has been already stopped
+func (o *outlierDetector) schedule(duration time.Duration, fn func()) bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if o.stopped {
+		return false
+	}
+
+	o.timer = time.AfterFunc(duration, fn)
+	return true
+}
+
+// stop cancels the scheduled restore
+func (o *outlierDetector) stop() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.stopped = true
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+}
+
+func (o *outlierDetector) isEjected() bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	return o.ejected
+}
+
+func newOutlierDetector(config *baker.OutlierDetection) *outlierDetector {
+	o := &outlierDetector{
+		consecutiveFailures: config.ConsecutiveFailures,
+		errorRate:           config.ErrorRate,
+		minRequests:         config.MinRequests,
+		interval:            config.Interval.Duration(),
+		baseEjection:        config.BaseEjection.Duration(),
+		maxEjection:         config.MaxEjection.Duration(),
+		windowStart:         time.Now(),
+	}
+
+	if o.consecutiveFailures <= 0 {
+		o.consecutiveFailures = defaultConsecutiveFailures
+	}
+
+	if o.minRequests <= 0 {
+		o.minRequests = defaultMinRequests
+	}
+
+	if o.interval <= 0 {
+		o.interval = defaultOutlierInterval
+	}
+
+	if o.baseEjection <= 0 {
+		o.baseEjection = defaultBaseEjection
+	}
+
+	if o.maxEjection <= 0 {
+		o.maxEjection = defaultMaxEjection
+	}
+
+	if o.maxEjection < o.baseEjection {
+		o.maxEjection = o.baseEjection
+	}
+
+	return o
+}
@@ -0,0 +1,112 @@
+package gateway_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "failing")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "stable")
+	}))
+	defer stable.Close()
+
+	outlierDetection := &baker.OutlierDetection{
+		ConsecutiveFailures: 2,
+		BaseEjection:        baker.Duration(100 * time.Millisecond),
+	}
+
+	handler := gateway.NewHandler()
+	for i, server := range []*httptest.Server{failing, stable} {
+		service := dummyUpstreamService(t, server, []string{"failing", "stable"}[i], baker.Rules{})
+		service.Config.OutlierDetection = outlierDetection
+		handler.Service(service, baker.ServiceAdded)
+	}
+
+	send := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+		return w.Header().Get("X-Backend")
+	}
+
+	// round robin sends every other request to failing backend
+	// which is ejected after its second failure
+	for i := 0; i < 4; i++ {
+		send()
+	}
+
+	for i := 0; i < 10; i++ {
+		if backend := send(); backend != "stable" {
+			t.Fatalf("expected failing backend to be ejected but got response from %s", backend)
+		}
+	}
+
+	waitFor(t, time.Second, func() bool {
+		return send() == "failing"
+	})
+}
+
+func TestOutlierDetectionUnreachable(t *testing.T) {
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	service := dummyUpstreamService(t, unreachable, "unreachable", baker.Rules{})
+	unreachable.Close()
+
+	service.Config.OutlierDetection = &baker.OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjection:        baker.Duration(time.Minute),
+		MaxEjectionPercent:  100,
+	}
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d but got %d", http.StatusBadGateway, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestOutlierDetectionMaxEjection(t *testing.T) {
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	service := dummyUpstreamService(t, unreachable, "unreachable", baker.Rules{})
+	unreachable.Close()
+
+	service.Config.OutlierDetection = &baker.OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjection:        baker.Duration(time.Minute),
+	}
+
+	handler := gateway.NewHandler()
+	handler.Service(service, baker.ServiceAdded)
+
+	// the only backend can't be ejected, so requests keep reaching it
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected status %d but got %d", http.StatusBadGateway, w.Code)
+		}
+	}
+
+	if status := handler.Status()[0]; !status.Ejected {
+		t.Fatalf("expected backend to be marked as ejected but got %+v", status)
+	}
+}
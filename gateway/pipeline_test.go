@@ -0,0 +1,110 @@
+package gateway_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker/container"
+	"github.com/alinz/baker/gateway"
+	"github.com/alinz/baker/service"
+)
+
+// waitForStatus sends requests to handler until it responds with expected status
+func waitForStatus(t *testing.T, handler http.Handler, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/hello", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status %d but got %d", expected, w.Code)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFilePipeline(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "baker-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := serverAddr(t, upstream, false)
+	filename := path.Join(dir, "upstreams.json")
+
+	content := fmt.Sprintf(`[{"id": "hello-1", "host": "%s", "port": %d, "config": {"domain": "example.com", "path": "/*", "ready": true}}]`, addr.Host(), addr.Port())
+	err = ioutil.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := gateway.NewHandler()
+	containers := container.NewFile(filename, 10*time.Millisecond)
+	services := service.New(service.NewStaticConfigLoader(), 10*time.Millisecond)
+
+	go containers.Pipe(services)
+	go services.Pipe(handler)
+	defer containers.Stop()
+
+	waitForStatus(t, handler, http.StatusOK)
+
+	// removing upstream from file removes the route
+	err = ioutil.WriteFile(filename, []byte(`[]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().Add(time.Second)
+	err = os.Chtimes(filename, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, handler, http.StatusNotFound)
+}
+
+func TestReplayPipeline(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+
+	addr := serverAddr(t, upstream, false)
+
+	// a recording of a container which is added and removed a second later
+	recording := fmt.Sprintf(`{"time":"2020-01-01T00:00:00Z","id":"hello-1","active":true,"host":"%s","port":%d,"config":{"domain":"example.com","path":"/*","ready":true}}
+{"time":"2020-01-01T00:00:01Z","id":"hello-1"}
+`, addr.Host(), addr.Port())
+
+	handler := gateway.NewHandler()
+	// played 4 times faster than recorded
+	containers := container.NewReplay(strings.NewReader(recording), 4)
+	services := service.New(service.NewStaticConfigLoader(), 10*time.Millisecond)
+
+	go containers.Pipe(services)
+	go services.Pipe(handler)
+	defer containers.Stop()
+
+	waitForStatus(t, handler, http.StatusOK)
+	waitForStatus(t, handler, http.StatusNotFound)
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// RetryCountHeader is set on responses which have been retried
+	RetryCountHeader = "X-Baker-Retry-Count"
+
+	defaultRetryBudget = 0.2
+	defaultMaxBodySize = 64 * 1024
+	// maxRetryTokens is number of retries which can be done in a burst
+	maxRetryTokens = 10
+)
+
+var (
+	errUnreachable    = errors.New("resource or service is unreachable")
+	errPerTryTimeout  = errors.New("upstream did not respond in time")
+	idempotentMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodTrace:   true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+	}
+)
+
+// retryBudget limits retries to a ratio of requests. Each request deposits
+// ratio of a token and each retry withdraws a whole token
+type retryBudget struct {
+	mux    sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func (b *retryBudget) setRatio(ratio float64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if ratio <= 0 {
+		ratio = defaultRetryBudget
+	}
+
+	b.ratio = ratio
+}
+
+func (b *retryBudget) deposit() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{
+		ratio:  defaultRetryBudget,
+		tokens: maxRetryTokens,
+	}
+}
+
+// bufferBody reads request's body so it can be sent more than once. false will
+// be returned if body is larger than maxSize, in that case the request's body
+// is restored and can only be sent once
+func bufferBody(r *http.Request, maxSize int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	if r.ContentLength > maxSize {
+		return nil, false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > maxSize {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return body, true, nil
+}
+
+// isDialError returns true if connection to upstream has never been established
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryable returns true if request can be safely sent again after given error
+func retryable(r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return idempotentMethods[r.Method] || isDialError(err)
+}
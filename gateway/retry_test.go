@@ -0,0 +1,202 @@
+package gateway_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/gateway"
+)
+
+// resetServer accepts connections and closes them as soon as a request is received
+func resetServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+}
+
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+}
+
+func retryHandler(t *testing.T, retry *baker.Retry, servers ...*httptest.Server) *gateway.Handler {
+	handler := gateway.NewHandler()
+	for i, server := range servers {
+		service := dummyUpstreamService(t, server, string(rune('a'+i)), baker.Rules{Retry: retry})
+		handler.Service(service, baker.ServiceAdded)
+	}
+	return handler
+}
+
+func TestRetryDialError(t *testing.T) {
+	closed := echoServer()
+	closed.Close()
+
+	ok := echoServer()
+	defer ok.Close()
+
+	handler := retryHandler(t, &baker.Retry{Attempts: 1}, closed, ok)
+
+	retried := false
+	for i := 0; i < 4; i++ {
+		// dial errors are retried for non idempotent methods too
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://example.com/service1", strings.NewReader("hello")))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", w.Code)
+		}
+
+		if w.Body.String() != "hello" {
+			t.Fatalf("expected body to be 'hello' but got '%s'", w.Body.String())
+		}
+
+		if w.Header().Get(gateway.RetryCountHeader) == "1" {
+			retried = true
+		}
+	}
+
+	if !retried {
+		t.Fatal("expected at least one request to be retried")
+	}
+}
+
+func TestRetryConnectionReset(t *testing.T) {
+	reset := resetServer()
+	defer reset.Close()
+
+	ok := echoServer()
+	defer ok.Close()
+
+	testCases := []struct {
+		method   string
+		expected int
+	}{
+		{method: http.MethodPut, expected: http.StatusOK},
+		{method: http.MethodPost, expected: http.StatusBadGateway},
+	}
+
+	for _, testCase := range testCases {
+		// only the reset server is selected first, ok server is added later
+		handler := retryHandler(t, &baker.Retry{Attempts: 2}, reset)
+
+		service := dummyUpstreamService(t, ok, "ok", baker.Rules{Retry: &baker.Retry{Attempts: 2}})
+		handler.Service(service, baker.ServiceAdded)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(testCase.method, "http://example.com/service1", strings.NewReader("hello")))
+
+		if w.Code != testCase.expected {
+			t.Fatalf("%s: expected status %d but got %d", testCase.method, testCase.expected, w.Code)
+		}
+	}
+}
+
+func TestRetryBodyTooLarge(t *testing.T) {
+	closed := echoServer()
+	closed.Close()
+
+	ok := echoServer()
+	defer ok.Close()
+
+	handler := retryHandler(t, &baker.Retry{Attempts: 1, MaxBodySize: 2}, closed, ok)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "http://example.com/service1", strings.NewReader("hello")))
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d but got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	ok := echoServer()
+	defer ok.Close()
+
+	retry := &baker.Retry{Attempts: 1, PerTryTimeout: baker.Duration(50 * time.Millisecond)}
+
+	handler := retryHandler(t, retry, slow, ok)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", w.Code)
+	}
+
+	if w.Header().Get(gateway.RetryCountHeader) != "1" {
+		t.Fatal("expected request to be retried once")
+	}
+
+	// without any other backend, request times out
+	handler = retryHandler(t, retry, slow)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status %d but got %d", http.StatusGatewayTimeout, w.Code)
+	}
+}
+
+func TestRetryKeepsOtherCookies(t *testing.T) {
+	closed := echoServer()
+	closed.Close()
+
+	ok := echoServer()
+	defer ok.Close()
+
+	handler := gateway.NewHandler()
+	for i, server := range []*httptest.Server{closed, ok} {
+		service := dummyUpstreamService(t, server, string(rune('a'+i)), baker.Rules{Retry: &baker.Retry{Attempts: 1}})
+		service.Config.Affinity = &baker.Affinity{Type: gateway.CookieAffinity}
+		handler.Service(service, baker.ServiceAdded)
+	}
+
+	// a middleware which sets its own cookie before proxying
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		handler.ServeHTTP(w, r)
+	})
+
+	retried := false
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		chain.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/service1", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", w.Code)
+		}
+
+		if w.Header().Get(gateway.RetryCountHeader) == "1" {
+			retried = true
+		}
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 2 || cookies[0].Name != "session" {
+			t.Fatalf("expected session and affinity cookies but got %v", cookies)
+		}
+	}
+
+	if !retried {
+		t.Fatal("expected at least one request to be retried")
+	}
+}
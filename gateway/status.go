@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// BackendStatus is a snapshot of backend's runtime state
+type BackendStatus struct {
+	ID          string  `json:"id"`
+	Domain      string  `json:"domain"`
+	Path        string  `json:"path"`
+	Addr        string  `json:"addr"`
+	Active      bool    `json:"active"`
+	Ready       bool    `json:"ready"`
+	Healthy     bool    `json:"healthy"`
+	Ejected     bool    `json:"ejected"`
+	Circuit     string  `json:"circuit"`
+	Outstanding int64   `json:"outstanding"`
+	LatencyMS   float64 `json:"latency_ms"`
+}
+
+// Status returns runtime state of all backends sorted by domain, path and id
+func (s *Handler) Status() []BackendStatus {
+	backends := s.domains.Backends()
+
+	result := make([]BackendStatus, 0, len(backends))
+	for _, backend := range backends {
+		result = append(result, BackendStatus{
+			ID:          backend.Container.ID,
+			Domain:      backend.Config.Domain,
+			Path:        backend.Config.Path,
+			Addr:        backend.Container.Addr.String(),
+			Active:      backend.Container.Active,
+			Ready:       backend.Config.Ready,
+			Healthy:     backend.Healthy(),
+			Ejected:     backend.Ejected(),
+			Circuit:     backend.Circuit().String(),
+			Outstanding: backend.Outstanding(),
+			LatencyMS:   backend.Latency().Seconds() * 1000,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.ID < b.ID
+	})
+
+	return result
+}
+
+// StatusHandler returns an http.Handler which responds with Status as json.
+// it should be served on a private address
+func (s *Handler) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
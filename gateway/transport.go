@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alinz/baker"
+)
+
+const (
+	dialTimeout           = 5 * time.Second
+	keepAlive             = 30 * time.Second
+	maxIdleConns          = 512
+	maxIdleConnsPerHost   = 64
+	idleConnTimeout       = 90 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	expectContinueTimeout = 1 * time.Second
+)
+
+// upstreamTLS returns tls settings for given service. Files and verification come
+// from container's labels, which are controlled by operator. Service's Config is
+// returned by service itself, so only its server_name is used
+func upstreamTLS(service *baker.Service) *baker.TLS {
+	tls := &baker.TLS{}
+	if service.Container.TLS != nil {
+		*tls = *service.Container.TLS
+	}
+
+	if service.Config != nil && service.Config.TLS != nil && service.Config.TLS.ServerName != "" {
+		tls.ServerName = service.Config.TLS.ServerName
+	}
+
+	return tls
+}
+
+// newTransport creates a transport which can talk to service's container.
+// each transport keeps its own pool of connections, so it needs to be reused
+// for all requests to the same container
+func newTransport(service *baker.Service) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ExpectContinueTimeout: expectContinueTimeout,
+	}
+
+	if service.Container.Addr.Secure() {
+		tlsConfig, err := upstreamTLS(service).Config()
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/pkg/logger"
+)
+
+type outcomeKey struct{}
+
+// outcome holds the result of proxying a request. It's passed through
+// request's context so reverse proxy's hooks can fill it
+type outcome struct {
+	status   int
+	err      error
+	canceled bool
+	// timedOut needs to be accessed atomically
+	timedOut int32
+	// onResponse is called once response's headers are received
+	onResponse func()
+}
+
+// failure returns an error if either upstream was unreachable or responded with 5xx.
+// canceled requests must not be reported at all, canceled is set by Handler
+func (o *outcome) failure() error {
+	if o.err != nil {
+		return o.err
+	}
+
+	if o.status >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream responded with status %d", o.status)
+	}
+
+	return nil
+}
+
+func withOutcome(r *http.Request, result *outcome) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), outcomeKey{}, result))
+}
+
+func outcomeFrom(r *http.Request) *outcome {
+	result, _ := r.Context().Value(outcomeKey{}).(*outcome)
+	return result
+}
+
+// upstream holds a reverse proxy and its transport for a single service
+type upstream struct {
+	fingerprint string
+	proxy       *httputil.ReverseProxy
+	transport   *http.Transport
+}
+
+// fingerprint returns a key which changes whenever something that upstream is built
+// from changes. container's address, rules and tls settings are part of it.
+func fingerprint(service *baker.Service) (string, error) {
+	var rules baker.Rules
+	if service.Config != nil {
+		rules = service.Config.Rules
+	}
+
+	value, err := json.Marshal(struct {
+		Addr   string      `json:"addr"`
+		Secure bool        `json:"secure"`
+		Rules  baker.Rules `json:"rules"`
+		TLS    *baker.TLS  `json:"tls"`
+	}{
+		Addr:   service.Container.Addr.String(),
+		Secure: service.Container.Addr.Secure(),
+		Rules:  rules,
+		TLS:    upstreamTLS(service),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func newUpstream(service *baker.Service, fingerprint string) (*upstream, error) {
+	transport, err := newTransport(service)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(endpoint.NewHTTPAddr(service.Container.Addr, "").String())
+	if err != nil {
+		return nil, err
+	}
+
+	// target's path is always "/", it needs to be cleared
+	// so default director does not add extra / at the end of each path
+	target.Path = ""
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if result := outcomeFrom(resp.Request); result != nil {
+			result.status = resp.StatusCode
+			if result.onResponse != nil {
+				result.onResponse()
+			}
+		}
+		return nil
+	}
+
+	// ErrorHandler does not write anything to response,
+	// Handler decides how to respond based on outcome
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logger.Error("failed to proxy request to service %s because %s", service.Container.ID, err)
+
+		if result := outcomeFrom(r); result != nil {
+			result.err = err
+		}
+	}
+
+	// Collect all directors as one wrapped one
+	director := func(r *http.Request) {}
+	if service.Config != nil {
+		for _, requestUpdater := range service.Config.Rules.RequestUpdaters {
+			director = requestUpdater.Director(director)
+		}
+	}
+
+	originalDirector := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		logger.Debug("Original Request URL: %s", r.URL)
+		// originalDirector needs to be called first before calling other directors
+		originalDirector(r)
+		logger.Debug("Request URL after applying default director: %s", r.URL)
+
+		// trailing / is not sent to upstream
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
+
+		director(r)
+		logger.Debug("Request URL after applying all directors: %s", r.URL)
+	}
+
+	return &upstream{
+		fingerprint: fingerprint,
+		proxy:       proxy,
+		transport:   transport,
+	}, nil
+}
+
+func (u *upstream) close() {
+	u.transport.CloseIdleConnections()
+}
+
+// Upstreams caches reverse proxies per container id. Each container
+// gets its own transport, which means its own pool of keep-alive connections
+type Upstreams struct {
+	mux   sync.RWMutex
+	store map[string]*upstream
+}
+
+// Get returns cached reverse proxy for given container id
+func (u *Upstreams) Get(id string) *httputil.ReverseProxy {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+
+	upstream, ok := u.store[id]
+	if !ok {
+		return nil
+	}
+
+	return upstream.proxy
+}
+
+// Update creates a reverse proxy for given service. Existing reverse proxy
+// only gets rebuilt if container's address, rules or tls settings have been changed
+func (u *Upstreams) Update(service *baker.Service) error {
+	key, err := fingerprint(service)
+	if err != nil {
+		return err
+	}
+
+	u.mux.RLock()
+	cached, ok := u.store[service.Container.ID]
+	u.mux.RUnlock()
+
+	if ok && cached.fingerprint == key {
+		return nil
+	}
+
+	upstream, err := newUpstream(service, key)
+	if err != nil {
+		return err
+	}
+
+	u.mux.Lock()
+	cached, ok = u.store[service.Container.ID]
+	u.store[service.Container.ID] = upstream
+	u.mux.Unlock()
+
+	if ok {
+		logger.Debug("upstream for service %s has been rebuilt", service.Container.ID)
+		cached.close()
+	}
+
+	return nil
+}
+
+// Remove removes cached reverse proxy and closes all idle connections
+func (u *Upstreams) Remove(id string) {
+	u.mux.Lock()
+	cached, ok := u.store[id]
+	delete(u.store, id)
+	u.mux.Unlock()
+
+	if ok {
+		cached.close()
+	}
+}
+
+// NewUpstreams creates Upstreams object
+func NewUpstreams() *Upstreams {
+	return &Upstreams{
+		store: make(map[string]*upstream),
+	}
+}
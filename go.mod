@@ -2,4 +2,7 @@ module github.com/alinz/baker
 
 go 1.13
 
-require golang.org/x/crypto v0.0.0-20191107222254-f4817d981bb6
+require (
+	golang.org/x/crypto v0.0.0-20191107222254-f4817d981bb6
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
+)
@@ -0,0 +1,166 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/alinz/baker/pkg/interval"
+)
+
+const (
+	DefaultInterval           = 10 * time.Second
+	DefaultTimeout            = 2 * time.Second
+	DefaultHealthyThreshold   = 2
+	DefaultUnhealthyThreshold = 3
+
+	// maxBodySize limits how much of response's body is read for body matching
+	maxBodySize = 64 * 1024
+)
+
+// Config describes how a health check is performed, zero values
+// will be replaced by defaults
+type Config struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedStatus     []int
+	ExpectedBody       string
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// Checker probes a url and keeps track of consecutive successes and failures
+// it calls notify only when health status changes
+type Checker struct {
+	client *http.Client
+	url    string
+	config Config
+	notify func(healthy bool, err error)
+
+	healthy   bool
+	successes int
+	failures  int
+}
+
+var _ interval.Ticker = (*Checker)(nil)
+
+func (c *Checker) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !c.expectedStatus(resp.StatusCode) {
+		// drain the body so connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+
+	if c.config.ExpectedBody != "" && !bytes.Contains(body, []byte(c.config.ExpectedBody)) {
+		return fmt.Errorf("response does not contain '%s'", c.config.ExpectedBody)
+	}
+
+	return nil
+}
+
+func (c *Checker) expectedStatus(status int) bool {
+	if len(c.config.ExpectedStatus) == 0 {
+		return status >= 200 && status < 400
+	}
+
+	for _, expected := range c.config.ExpectedStatus {
+		if status == expected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Healthy returns current health status
+func (c *Checker) Healthy() bool {
+	return c.healthy
+}
+
+// Tick probes the url once and updates health status
+// NOTE: do not call this method concurrently, it's designed to be called by interval.Run
+func (c *Checker) Tick(ctx context.Context) error {
+	err := c.probe(ctx)
+	if ctx.Err() != nil {
+		// checker is stopped, result of the last probe is meaningless
+		return nil
+	}
+
+	if err != nil {
+		c.successes = 0
+		c.failures++
+
+		if c.healthy && c.failures >= c.config.UnhealthyThreshold {
+			c.healthy = false
+			c.notify(false, err)
+		}
+
+		return nil
+	}
+
+	c.failures = 0
+	c.successes++
+
+	if !c.healthy && c.successes >= c.config.HealthyThreshold {
+		c.healthy = true
+		c.notify(true, nil)
+	}
+
+	return nil
+}
+
+// Run probes the url on every interval until ctx is canceled
+// NOTE: this method is blocking
+func (c *Checker) Run(ctx context.Context) {
+	interval.Run(ctx, c, c.config.Interval)
+}
+
+// New creates a Checker which starts as healthy
+func New(client *http.Client, url string, config Config, notify func(healthy bool, err error)) *Checker {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = DefaultHealthyThreshold
+	}
+
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+
+	return &Checker{
+		client:  client,
+		url:     url,
+		config:  config,
+		notify:  notify,
+		healthy: true,
+	}
+}
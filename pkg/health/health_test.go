@@ -0,0 +1,80 @@
+package health_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alinz/baker/pkg/health"
+)
+
+func TestChecker(t *testing.T) {
+	var status int32 = http.StatusOK
+	body := "ok"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	changes := make([]bool, 0)
+	checker := health.New(server.Client(), server.URL, health.Config{
+		ExpectedBody:       "ok",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}, func(healthy bool, err error) {
+		changes = append(changes, healthy)
+	})
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		status   int32
+		body     string
+		expected bool
+	}{
+		{status: http.StatusOK, body: "ok", expected: true},
+		{status: http.StatusInternalServerError, body: "ok", expected: true},
+		{status: http.StatusInternalServerError, body: "ok", expected: true},
+		{status: http.StatusOK, body: "not", expected: false},
+		{status: http.StatusOK, body: "ok", expected: false},
+		{status: http.StatusOK, body: "ok", expected: true},
+		{status: http.StatusServiceUnavailable, body: "ok", expected: true},
+	}
+
+	for i, testCase := range testCases {
+		atomic.StoreInt32(&status, testCase.status)
+		body = testCase.body
+
+		checker.Tick(ctx)
+
+		if checker.Healthy() != testCase.expected {
+			t.Fatalf("step %d: expected healthy to be %t", i, testCase.expected)
+		}
+	}
+
+	if len(changes) != 2 || changes[0] != false || changes[1] != true {
+		t.Fatalf("expected exactly two changes but got %v", changes)
+	}
+}
+
+func TestCheckerExpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	checker := health.New(server.Client(), server.URL, health.Config{
+		ExpectedStatus:     []int{http.StatusTeapot},
+		UnhealthyThreshold: 1,
+	}, func(healthy bool, err error) {})
+
+	checker.Tick(context.Background())
+	if !checker.Healthy() {
+		t.Fatal("expected checker to be healthy")
+	}
+}
@@ -14,3 +14,21 @@ func ResponseAsError(w http.ResponseWriter, statusCode int, err error) {
 		Error: err.Error(),
 	})
 }
+
+// ResponseAsProblem writes an RFC 7807 problem details response
+func ResponseAsProblem(w http.ResponseWriter, statusCode int, title string, err error) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(statusCode)
+
+	json.NewEncoder(w).Encode(struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+	}{
+		Type:   "about:blank",
+		Title:  title,
+		Status: statusCode,
+		Detail: err.Error(),
+	})
+}
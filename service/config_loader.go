@@ -3,39 +3,257 @@ package service
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/pkg/endpoint"
 )
 
+// ErrNoConfig is returned by a ConfigLoader which is not responsible for given container
+var ErrNoConfig = errors.New("no config for container")
+
 type ConfigLoader interface {
-	Config(addr endpoint.HTTPAddr) (*baker.Config, error)
+	Config(container *baker.Container) (*baker.Config, error)
+}
+
+// ConfigLoaders tries each loader in order until one of them
+// returns anything other than ErrNoConfig
+type ConfigLoaders []ConfigLoader
+
+var _ ConfigLoader = (ConfigLoaders)(nil)
+
+func (c ConfigLoaders) Config(container *baker.Container) (*baker.Config, error) {
+	for _, loader := range c {
+		config, err := loader.Config(container)
+		if err == ErrNoConfig {
+			continue
+		}
+
+		return config, err
+	}
+
+	return nil, ErrNoConfig
+}
+
+// ConfigExpirer is implemented by a ConfigLoader which caches configs.
+// Container is not pinged again until its config expires
+type ConfigExpirer interface {
+	Expires(container *baker.Container) time.Time
+}
+
+var _ ConfigExpirer = (ConfigLoaders)(nil)
+
+// Expires returns the first expiry which is known by loaders
+func (c ConfigLoaders) Expires(container *baker.Container) time.Time {
+	for _, loader := range c {
+		expirer, ok := loader.(ConfigExpirer)
+		if !ok {
+			continue
+		}
+
+		if expires := expirer.Expires(container); !expires.IsZero() {
+			return expires
+		}
+	}
+
+	return time.Time{}
+}
+
+// ConfigCacheIdle is how long a cached config is kept once its container stops being pinged
+var ConfigCacheIdle = 10 * time.Minute
+
+// cachedConfig is the last config of a container. etag and lastModified are sent back,
+// so container can respond with 304 if config hasn't been changed. Config is not
+// fetched again until expires, which is set by Cache-Control's max-age.
+// body is kept instead of the decoded config, so every caller gets its own copy
+type cachedConfig struct {
+	url          string
+	etag         string
+	lastModified string
+	body         []byte
+	expires      time.Time
+	used         time.Time
 }
 
 type LoadConfig struct {
 	client       *http.Client
 	secureClient *http.Client
+
+	mux     sync.Mutex
+	clients map[baker.TLS]*http.Client
+	cache   map[string]*cachedConfig
+	swept   time.Time
 }
 
 var _ ConfigLoader = (*LoadConfig)(nil)
+var _ ConfigExpirer = (*LoadConfig)(nil)
+
+// secureClientFor returns a client which respects container's tls settings.
+// clients are cached by tls settings, so containers with same settings share one
+func (c *LoadConfig) secureClientFor(container *baker.Container) (*http.Client, error) {
+	if container.TLS == nil {
+		return c.secureClient, nil
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	client, ok := c.clients[*container.TLS]
+	if ok {
+		return client, nil
+	}
+
+	tlsConfig, err := container.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	client = endpoint.NewClient(tlsConfig)
+	c.clients[*container.TLS] = client
+
+	return client, nil
+}
+
+// Config loads Config object from container's ping address
+func (c *LoadConfig) Config(container *baker.Container) (*baker.Config, error) {
+	addr := container.PingAddr
+	if addr == nil {
+		return nil, errors.New("container has no ping address")
+	}
 
-// Config loads Config object from given address
-func (c *LoadConfig) Config(addr endpoint.HTTPAddr) (*baker.Config, error) {
 	client := c.client
 	if addr.Secure() {
-		client = c.secureClient
+		var err error
+		client, err = c.secureClientFor(container)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	url := addr.String()
+	now := time.Now()
+
+	cached := c.cached(container.ID, url, now)
+	if cached != nil && now.Before(cached.expires) {
+		return decodeConfig(cached.body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
 	}
 
 	// send ping request
-	resp, err := client.Get(addr.String())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	maxAge, noStore := cacheControl(resp.Header.Get("Cache-Control"))
+
+	// config hasn't been changed since the last request
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		c.mux.Lock()
+		cached.expires = now.Add(maxAge)
+		c.mux.Unlock()
+
+		return decodeConfig(cached.body)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	// decode ping response
+	config, err := decodeConfig(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK && !noStore {
+		c.mux.Lock()
+		c.cache[container.ID] = &cachedConfig{
+			url:          url,
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			body:         body,
+			expires:      now.Add(maxAge),
+			used:         now,
+		}
+		c.mux.Unlock()
+
+		return config, nil
+	}
+
+	c.mux.Lock()
+	delete(c.cache, container.ID)
+	c.mux.Unlock()
+
+	return config, nil
+}
+
+// cached returns the cached config of container if it's been fetched from the same url.
+// It also removes configs of containers which haven't been pinged for ConfigCacheIdle
+func (c *LoadConfig) cached(id string, url string, now time.Time) *cachedConfig {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if now.Sub(c.swept) > ConfigCacheIdle {
+		for key, cached := range c.cache {
+			if now.Sub(cached.used) > ConfigCacheIdle {
+				delete(c.cache, key)
+			}
+		}
+		c.swept = now
+	}
+
+	cached, ok := c.cache[id]
+	if !ok || cached.url != url {
+		return nil
+	}
+
+	cached.used = now
+	return cached
+}
+
+// Expires returns when the cached config of container expires.
+// zero time is returned if container's config is not cached
+func (c *LoadConfig) Expires(container *baker.Container) time.Time {
+	if container.PingAddr == nil {
+		return time.Time{}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cached, ok := c.cache[container.ID]
+	if !ok || cached.url != container.PingAddr.String() {
+		return time.Time{}
+	}
+
+	return cached.expires
+}
+
+func decodeConfig(body []byte) (*baker.Config, error) {
 	config := &baker.Config{}
-	err = json.NewDecoder(resp.Body).Decode(config)
+	err := json.Unmarshal(body, config)
 	if err != nil {
 		return nil, err
 	}
@@ -43,9 +261,33 @@ func (c *LoadConfig) Config(addr endpoint.HTTPAddr) (*baker.Config, error) {
 	return config, nil
 }
 
+// cacheControl parses max-age of Cache-Control header. no-cache and missing
+// max-age mean config needs to be checked on every ping
+func cacheControl(value string) (maxAge time.Duration, noStore bool) {
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		case directive == "no-store":
+			return 0, true
+		case directive == "no-cache":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && seconds > 0 {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return maxAge, false
+}
+
 func NewConfigLoader(tls *tls.Config) *LoadConfig {
 	return &LoadConfig{
 		client:       endpoint.NewClient(nil),
 		secureClient: endpoint.NewClient(tls),
+		clients:      make(map[baker.TLS]*http.Client),
+		cache:        make(map[string]*cachedConfig),
 	}
 }
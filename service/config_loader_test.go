@@ -0,0 +1,121 @@
+package service_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/pkg/endpoint"
+	"github.com/alinz/baker/service"
+)
+
+// configServer serves a config with an etag and counts requests by their status
+type configServer struct {
+	mux          sync.Mutex
+	path         string
+	cacheControl string
+	statuses     []int
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	etag := `"` + s.path + `"`
+
+	w.Header().Set("ETag", etag)
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+
+	if r.Header.Get("If-None-Match") == etag {
+		s.statuses = append(s.statuses, http.StatusNotModified)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.statuses = append(s.statuses, http.StatusOK)
+	fmt.Fprintf(w, `{"domain": "example.com", "path": "%s", "ready": true, "affinity": {"type": "cookie"}}`, s.path)
+}
+
+func (s *configServer) set(path string, cacheControl string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.path = path
+	s.cacheControl = cacheControl
+}
+
+func (s *configServer) requests() []int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	statuses := s.statuses
+	s.statuses = nil
+	return statuses
+}
+
+func TestConfigLoaderConditional(t *testing.T) {
+	server := &configServer{path: "/v1"}
+
+	upstream := httptest.NewServer(server)
+	defer upstream.Close()
+
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	addr := endpoint.NewAddr(host, p, false)
+
+	container := &baker.Container{
+		ID:       "1",
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, "/config"),
+	}
+
+	loader := service.NewConfigLoader(nil)
+
+	load := func(expectedPath string, expectedStatuses ...int) {
+		config, err := loader.Config(container)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Path != expectedPath || config.Affinity == nil || config.Affinity.Type != "cookie" {
+			t.Fatalf("expected path %s but got %+v", expectedPath, config)
+		}
+
+		statuses := server.requests()
+		if fmt.Sprint(statuses) != fmt.Sprint(expectedStatuses) {
+			t.Fatalf("expected requests %v but got %v", expectedStatuses, statuses)
+		}
+
+		// cached config is never shared with callers
+		config.Affinity.Type = "changed"
+	}
+
+	load("/v1", http.StatusOK)
+	// etag is sent back, so config is not downloaded again
+	load("/v1", http.StatusNotModified)
+
+	server.set("/v2", "max-age=60")
+	load("/v2", http.StatusOK)
+	// max-age skips the request entirely
+	load("/v2")
+
+	expires := loader.Expires(container)
+	if until := time.Until(expires); until < 50*time.Second || until > 60*time.Second {
+		t.Fatalf("expected config to expire in 60s but got %s", until)
+	}
+
+	// no-store disables caching
+	server.set("/v3", "no-store")
+	loader = service.NewConfigLoader(nil)
+	load("/v3", http.StatusOK)
+	load("/v3", http.StatusOK)
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/alinz/baker"
+)
+
+// Labels which describe a container's config without ping endpoint
+const (
+	// LabelConfig selects how config is loaded, it can be either labels or ping.
+	// if it's not set, labels are used if baker.domain is presented
+	LabelConfig     = "baker.config"
+	LabelDomain     = "baker.domain"
+	LabelPath       = "baker.path"
+	LabelIncludeWWW = "baker.include_www"
+	LabelReady      = "baker.ready"
+	// LabelRules holds baker.Rules encoded as json
+	LabelRules = "baker.rules"
+)
+
+const (
+	ConfigFromLabels = "labels"
+	ConfigFromPing   = "ping"
+)
+
+// LoadLabelConfig builds config from container's labels
+type LoadLabelConfig struct{}
+
+var _ ConfigLoader = (*LoadLabelConfig)(nil)
+
+func parseBoolLabel(labels map[string]string, key string, defaultValue bool) (bool, error) {
+	value, ok := labels[key]
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse label '%s' because %s", key, err)
+	}
+
+	return result, nil
+}
+
+// Config builds config from container's labels. ErrNoConfig will be returned if
+// container is not configured by labels. Containers which are configured by labels
+// are ready unless baker.ready is false
+func (l *LoadLabelConfig) Config(container *baker.Container) (*baker.Config, error) {
+	labels := container.Labels
+
+	switch labels[LabelConfig] {
+	case ConfigFromPing:
+		return nil, ErrNoConfig
+	case ConfigFromLabels:
+		if labels[LabelDomain] == "" {
+			return nil, fmt.Errorf("label '%s' is required", LabelDomain)
+		}
+	case "":
+		if labels[LabelDomain] == "" {
+			return nil, ErrNoConfig
+		}
+	default:
+		return nil, fmt.Errorf("label '%s' has unknown value '%s'", LabelConfig, labels[LabelConfig])
+	}
+
+	includeWWW, err := parseBoolLabel(labels, LabelIncludeWWW, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ready, err := parseBoolLabel(labels, LabelReady, true)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &baker.Config{
+		Domain:     labels[LabelDomain],
+		Path:       labels[LabelPath],
+		IncludeWWW: includeWWW,
+		Ready:      ready,
+	}
+
+	if config.Path == "" {
+		config.Path = "/*"
+	}
+
+	if rules, ok := labels[LabelRules]; ok && rules != "" {
+		err = json.Unmarshal([]byte(rules), &config.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label '%s' because %s", LabelRules, err)
+		}
+	}
+
+	return config, nil
+}
+
+// NewLabelConfigLoader creates a loader which builds config from labels
+func NewLabelConfigLoader() *LoadLabelConfig {
+	return &LoadLabelConfig{}
+}
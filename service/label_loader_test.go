@@ -0,0 +1,127 @@
+package service_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alinz/baker"
+	"github.com/alinz/baker/rule"
+	"github.com/alinz/baker/service"
+)
+
+func TestLabelConfigLoader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected *baker.Config
+		err      error
+	}{
+		{
+			name:   "no labels",
+			labels: map[string]string{},
+			err:    service.ErrNoConfig,
+		},
+		{
+			name: "ping is selected",
+			labels: map[string]string{
+				"baker.config": "ping",
+				"baker.domain": "example.com",
+			},
+			err: service.ErrNoConfig,
+		},
+		{
+			name: "labels without domain",
+			labels: map[string]string{
+				"baker.config": "labels",
+			},
+			err: errors.New("label 'baker.domain' is required"),
+		},
+		{
+			name: "domain only",
+			labels: map[string]string{
+				"baker.domain": "example.com",
+			},
+			expected: &baker.Config{
+				Domain: "example.com",
+				Path:   "/*",
+				Ready:  true,
+			},
+		},
+		{
+			name: "all labels",
+			labels: map[string]string{
+				"baker.config":      "labels",
+				"baker.domain":      "example.com",
+				"baker.path":        "/grafana/*",
+				"baker.include_www": "true",
+				"baker.ready":       "false",
+				"baker.rules":       `{"request_updaters":[{"name":"replace_path","search":"/grafana","replace":"","times":-1}]}`,
+			},
+			expected: &baker.Config{
+				Domain:     "example.com",
+				Path:       "/grafana/*",
+				IncludeWWW: true,
+				Ready:      false,
+				Rules: baker.Rules{
+					RequestUpdaters: rule.RequestUpdaters{
+						&rule.ReplacePath{Name: "replace_path", Search: "/grafana", Replace: "", Times: -1},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid rules",
+			labels: map[string]string{
+				"baker.domain": "example.com",
+				"baker.rules":  `{"request_updaters":[{"name":"unknown"}]}`,
+			},
+			err: errors.New("failed to parse label 'baker.rules' because failed to process unknown RequestUpdater"),
+		},
+	}
+
+	loader := service.NewLabelConfigLoader()
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config, err := loader.Config(&baker.Container{ID: "1", Labels: testCase.labels})
+
+			if testCase.err != nil {
+				if err == nil || err.Error() != testCase.err.Error() {
+					t.Fatalf("expected error '%s' but got '%v'", testCase.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Domain != testCase.expected.Domain || config.Path != testCase.expected.Path ||
+				config.IncludeWWW != testCase.expected.IncludeWWW || config.Ready != testCase.expected.Ready {
+				t.Fatalf("expected %+v but got %+v", testCase.expected, config)
+			}
+
+			if len(config.Rules.RequestUpdaters) != len(testCase.expected.Rules.RequestUpdaters) {
+				t.Fatalf("expected %d rules but got %d", len(testCase.expected.Rules.RequestUpdaters), len(config.Rules.RequestUpdaters))
+			}
+		})
+	}
+}
+
+func TestConfigLoaders(t *testing.T) {
+	ping := ConfigLoaderFn(func(container *baker.Container) (*baker.Config, error) {
+		return &baker.Config{Domain: "ping.com"}, nil
+	})
+
+	loaders := service.ConfigLoaders{service.NewLabelConfigLoader(), ping}
+
+	config, err := loaders.Config(&baker.Container{Labels: map[string]string{"baker.domain": "labels.com"}})
+	if err != nil || config.Domain != "labels.com" {
+		t.Fatalf("expected config from labels but got %+v, %v", config, err)
+	}
+
+	config, err = loaders.Config(&baker.Container{})
+	if err != nil || config.Domain != "ping.com" {
+		t.Fatalf("expected config from ping but got %+v, %v", config, err)
+	}
+}
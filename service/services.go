@@ -1,20 +1,29 @@
 package service
 
 import (
-	"context"
 	"errors"
+	"math/rand"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/alinz/baker"
 	"github.com/alinz/baker/container"
-	"github.com/alinz/baker/pkg/interval"
 	"github.com/alinz/baker/pkg/logger"
 )
 
-// Consumer defines all required method which producer will Call
+// PingWorkers limits how many configs are loaded at the same time, so a slow container
+// only holds one worker. PingJitter spreads pings of containers over a fraction of
+// ping interval, so they don't all happen at once
+var (
+	PingWorkers = 16
+	PingJitter  = 0.2
+)
+
+// Consumer defines all required method which producer will Call.
+// Service is only called once a service has been changed
 type Consumer interface {
-	Service(service *baker.Service) error
+	Service(service *baker.Service, change baker.Change) error
 	Close(err error)
 }
 
@@ -23,80 +32,237 @@ type Producer interface {
 	Pipe(consumer Consumer)
 }
 
+// scheduled is a container which is pinged periodically. version changes once container is replaced,
+// so a config which has been loaded for a previous container is ignored
+type scheduled struct {
+	container *baker.Container
+	version   uint64
+	timer     *time.Timer
+	running   bool
+}
+
+// result is a loaded config or a removed container.
+// expires is set if config loader knows when config expires
+type result struct {
+	service *baker.Service
+	entry   *scheduled
+	version uint64
+	expires time.Time
+	removed bool
+}
+
 // ProduceService is an implementation for Producer, it implements container.Consumer
-// to consume containers and tries to fetch config from each container to produce service object
+// to consume containers and tries to fetch config from each container to produce service object.
+// Each container is pinged on its own timer by a bounded pool of workers
 type ProduceService struct {
 	configLoader ConfigLoader
 	pingInterval time.Duration
-	mux          sync.RWMutex
-	table        map[string]*baker.Container
-	containers   chan *baker.Container
+	mux          sync.Mutex
+	entries      map[string]*scheduled
+	version      uint64
+	due          chan string
+	results      chan *result
 }
 
 var _ Producer = (*ProduceService)(nil)
 var _ container.Consumer = (*ProduceService)(nil)
-var _ interval.Ticker = (*ProduceService)(nil)
 
 // Pipe will be called by higher implementation which give us
 // the actual consumer for passing services
 // NOTE: this method is a blocking call
 func (p *ProduceService) Pipe(consumer Consumer) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// interval.Run is a blocking call and needs to be run
-	// inside a goroutine. In order to cancel it, a cancelable context is
-	// used and once this method is terminated, defer function will cancel
-	// the interval
-	go interval.Run(ctx, p, p.pingInterval)
+	defer consumer.Close(nil)
 
-	defer func() {
-		cancel()
-		consumer.Close(nil)
-	}()
+	for i := 0; i < PingWorkers; i++ {
+		go p.worker()
+	}
 
-	for container := range p.containers {
-		var config *baker.Config
-		var err error
+	// last keeps the last service which has been passed to consumer per container,
+	// so services are only passed once they have been changed
+	last := make(map[string]*baker.Service)
 
-		err = container.Err
+	for result := range p.results {
+		id := result.service.Container.ID
 
-		if err == nil {
-			config, err = p.configLoader.Config(container.PingAddr)
+		if !result.removed && !p.done(id, result.entry, result.version, result.expires) {
+			continue
 		}
 
-		service := &baker.Service{
-			Container: container,
-			Config:    config,
-			Err:       err,
+		service, change := compare(last[id], result.service, result.removed)
+		if change == 0 {
+			continue
 		}
 
-		err = consumer.Service(service)
+		logger.Debug("service %s has been %s", id, change)
+
+		err := consumer.Service(service, change)
 		if err != nil {
 			logger.Error("failed to call consumer.Service because %s", err)
+
+			// consumer has not accepted the service, so it's passed again on the next ping
+			delete(last, id)
+			continue
+		}
+
+		if change == baker.ServiceRemoved {
+			delete(last, id)
+		} else {
+			last[id] = service
+		}
+	}
+}
+
+// worker loads configs of due containers
+func (p *ProduceService) worker() {
+	for id := range p.due {
+		p.mux.Lock()
+		entry, ok := p.entries[id]
+		if !ok || entry.running {
+			// container is removed or it's already being pinged,
+			// which schedules it again once it's done
+			p.mux.Unlock()
+			continue
+		}
+		entry.running = true
+		container := entry.container
+		version := entry.version
+		p.mux.Unlock()
+
+		var config *baker.Config
+		var expires time.Time
+
+		err := container.Err
+		if err == nil {
+			config, err = p.configLoader.Config(container)
+		}
+
+		if expirer, ok := p.configLoader.(ConfigExpirer); ok && err == nil {
+			expires = expirer.Expires(container)
+		}
+
+		p.results <- &result{
+			service: &baker.Service{
+				Container: container,
+				Config:    config,
+				Err:       err,
+			},
+			entry:   entry,
+			version: version,
+			expires: expires,
+		}
+	}
+}
+
+// done schedules the next ping of container and reports whether
+// the loaded config belongs to the current container. Container is not
+// pinged again before its config expires
+func (p *ProduceService) done(id string, entry *scheduled, version uint64, expires time.Time) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// container has been removed, and might have been added again
+	if p.entries[id] != entry {
+		return false
+	}
+
+	entry.running = false
+
+	// container has been replaced while it was being pinged
+	if entry.version != version {
+		entry.timer.Reset(0)
+		return false
+	}
+
+	next := p.nextPing()
+	if wait := time.Until(expires); wait > next {
+		next = wait
+	}
+
+	entry.timer.Reset(next)
+	return true
+}
+
+// nextPing returns ping interval with a random jitter
+func (p *ProduceService) nextPing() time.Duration {
+	jitter := (rand.Float64()*2 - 1) * PingJitter * float64(p.pingInterval)
+	return p.pingInterval + time.Duration(jitter)
+}
+
+// compare compares service with the previous one which has been passed to consumer.
+// change is zero if nothing has been changed
+func compare(previous *baker.Service, service *baker.Service, removed bool) (*baker.Service, baker.Change) {
+	if removed {
+		if previous == nil {
+			return nil, 0
 		}
+
+		return service, baker.ServiceRemoved
 	}
+
+	switch {
+	case service.Err != nil:
+		if previous != nil && previous.Err != nil {
+			return nil, 0
+		}
+
+		// config is dropped, so consumer stops routing to this service
+		service.Config = nil
+		return service, baker.ServiceErrored
+
+	case previous == nil || previous.Err != nil:
+		return service, baker.ServiceAdded
+
+	case !previous.Container.Equal(service.Container) || !reflect.DeepEqual(previous.Config, service.Config):
+		return service, baker.ServiceUpdated
+	}
+
+	return nil, 0
 }
 
 // Container calls by container.Producer when a new container is available.
-// Container will delete record in table if container is not active
+// New and updated containers are pinged right away and inactive ones are removed
 func (p *ProduceService) Container(container *baker.Container) error {
 	p.mux.Lock()
-	defer p.mux.Unlock()
 
 	if !container.Active {
-		delete(p.table, container.ID)
+		if entry, ok := p.entries[container.ID]; ok {
+			entry.timer.Stop()
+			delete(p.entries, container.ID)
+		}
+		p.mux.Unlock()
+
 		container.Err = errors.New("container is not active")
-		p.containers <- container
+		p.results <- &result{
+			service: &baker.Service{
+				Container: container,
+				Err:       container.Err,
+			},
+			removed: true,
+		}
 		return nil
 	}
 
-	c, ok := p.table[container.ID]
+	defer p.mux.Unlock()
+
+	// producer might send an updated container, e.g. with a new address,
+	// which replaces the previous one
+	p.version++
+
+	entry, ok := p.entries[container.ID]
 	if !ok {
-		p.table[container.ID] = container
-		return nil
+		id := container.ID
+		entry = &scheduled{}
+		entry.timer = time.AfterFunc(0, func() {
+			p.due <- id
+		})
+		p.entries[id] = entry
+	} else if !entry.running {
+		entry.timer.Reset(0)
 	}
 
-	c.Err = container.Err
+	entry.container = container
+	entry.version = p.version
+
 	return nil
 }
 
@@ -105,31 +271,13 @@ func (p *ProduceService) Close(err error) {
 	return
 }
 
-// Tick reads the internal table and push all the items in table into a channel
-// NOTE: do not call this method, this will be called by interval.Run package.
-func (p *ProduceService) Tick(ctx context.Context) error {
-	p.mux.RLock()
-	defer p.mux.RUnlock()
-
-	for _, container := range p.table {
-
-		select {
-		case p.containers <- container:
-		case <-ctx.Done():
-			close(p.containers)
-			break
-		}
-	}
-
-	return nil
-}
-
 // New initialize ServiceProdicer object
 func New(configLoader ConfigLoader, pingInterval time.Duration) *ProduceService {
 	return &ProduceService{
 		configLoader: configLoader,
 		pingInterval: pingInterval,
-		table:        make(map[string]*baker.Container, 0),
-		containers:   make(chan *baker.Container),
+		entries:      make(map[string]*scheduled),
+		due:          make(chan string),
+		results:      make(chan *result),
 	}
 }
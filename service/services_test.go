@@ -1,7 +1,9 @@
 package service_test
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,21 +12,31 @@ import (
 	"github.com/alinz/baker/service"
 )
 
-type ConfigLoaderFn func(addr endpoint.HTTPAddr) (*baker.Config, error)
+type ConfigLoaderFn func(container *baker.Container) (*baker.Config, error)
 
 var _ service.ConfigLoader = (*ConfigLoaderFn)(nil)
 
-func (cl ConfigLoaderFn) Config(addr endpoint.HTTPAddr) (*baker.Config, error) {
-	return cl(addr)
+func (cl ConfigLoaderFn) Config(container *baker.Container) (*baker.Config, error) {
+	return cl(container)
+}
+
+// expiringConfigLoader is a ConfigLoaderFn whose configs expire at expires
+type expiringConfigLoader struct {
+	ConfigLoaderFn
+	expires time.Time
+}
+
+func (e *expiringConfigLoader) Expires(container *baker.Container) time.Time {
+	return e.expires
 }
 
 type ConsumerFn struct {
-	service func(service *baker.Service) error
+	service func(service *baker.Service, change baker.Change) error
 	close   func(err error)
 }
 
-func (c *ConsumerFn) Service(service *baker.Service) error {
-	return c.service(service)
+func (c *ConsumerFn) Service(service *baker.Service, change baker.Change) error {
+	return c.service(service, change)
 }
 
 func (c *ConsumerFn) Close(err error) {
@@ -35,7 +47,7 @@ func TestServices(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	dummyConfigLoader := ConfigLoaderFn(func(addr endpoint.HTTPAddr) (*baker.Config, error) {
+	dummyConfigLoader := ConfigLoaderFn(func(container *baker.Container) (*baker.Config, error) {
 		return &baker.Config{
 			Domain: "example.com",
 			Path:   "/api",
@@ -43,7 +55,7 @@ func TestServices(t *testing.T) {
 	})
 
 	consumerFn := &ConsumerFn{
-		service: func(service *baker.Service) error {
+		service: func(service *baker.Service, change baker.Change) error {
 			wg.Done()
 			return nil
 		},
@@ -67,3 +79,246 @@ func TestServices(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestServicesChanges(t *testing.T) {
+	var mux sync.Mutex
+	config := &baker.Config{Domain: "example.com", Path: "/api"}
+	var configErr error
+
+	configLoader := ConfigLoaderFn(func(container *baker.Container) (*baker.Config, error) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if configErr != nil {
+			return nil, configErr
+		}
+
+		// loaders return a new config on every call
+		copied := *config
+		return &copied, nil
+	})
+
+	setConfig := func(c *baker.Config, err error) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		config = c
+		configErr = err
+	}
+
+	changes := make(chan baker.Change, 10)
+
+	services := service.New(configLoader, 10*time.Millisecond)
+	go services.Pipe(&ConsumerFn{
+		service: func(service *baker.Service, change baker.Change) error {
+			changes <- change
+			return nil
+		},
+		close: func(err error) {},
+	})
+
+	expect := func(expected baker.Change) {
+		select {
+		case change := <-changes:
+			if change != expected {
+				t.Fatalf("expected %s but got %s", expected, change)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", expected)
+		}
+
+		// nothing is changed for the next ticks
+		select {
+		case change := <-changes:
+			t.Fatalf("unexpected %s", change)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	addr := endpoint.NewAddr("0.0.0.0", 8000, false)
+	services.Container(&baker.Container{
+		ID:       "1",
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, "/ping"),
+	})
+	expect(baker.ServiceAdded)
+
+	setConfig(&baker.Config{Domain: "example.com", Path: "/v2"}, nil)
+	expect(baker.ServiceUpdated)
+
+	// container with a new address
+	addr = endpoint.NewAddr("0.0.0.0", 9000, false)
+	services.Container(&baker.Container{
+		ID:       "1",
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, "/ping"),
+	})
+	expect(baker.ServiceUpdated)
+
+	setConfig(nil, errors.New("ping failed"))
+	expect(baker.ServiceErrored)
+
+	setConfig(&baker.Config{Domain: "example.com", Path: "/v2"}, nil)
+	expect(baker.ServiceAdded)
+
+	services.Container(&baker.Container{ID: "1"})
+	expect(baker.ServiceRemoved)
+}
+
+func TestServicesConsumerFailed(t *testing.T) {
+	configLoader := ConfigLoaderFn(func(container *baker.Container) (*baker.Config, error) {
+		return &baker.Config{Domain: "example.com", Path: "/"}, nil
+	})
+
+	changes := make(chan baker.Change, 10)
+	var calls int32
+
+	services := service.New(configLoader, 10*time.Millisecond)
+	go services.Pipe(&ConsumerFn{
+		service: func(service *baker.Service, change baker.Change) error {
+			changes <- change
+
+			// consumer fails once, e.g. upstream of service can't be created
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return errors.New("failed")
+			}
+			return nil
+		},
+		close: func(err error) {},
+	})
+
+	addr := endpoint.NewAddr("0.0.0.0", 8000, false)
+	services.Container(&baker.Container{
+		ID:       "1",
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, "/ping"),
+	})
+
+	// failed service is passed again on the next ping
+	for i := 0; i < 2; i++ {
+		select {
+		case change := <-changes:
+			if change != baker.ServiceAdded {
+				t.Fatalf("expected %s but got %s", baker.ServiceAdded, change)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", baker.ServiceAdded)
+		}
+	}
+
+	// accepted service is not passed again
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected %s", change)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServicesSlowContainer(t *testing.T) {
+	release := make(chan struct{})
+
+	var mux sync.Mutex
+	pings := make(map[string]int)
+
+	configLoader := ConfigLoaderFn(func(container *baker.Container) (*baker.Config, error) {
+		mux.Lock()
+		pings[container.ID]++
+		mux.Unlock()
+
+		if container.ID == "slow" {
+			<-release
+		}
+
+		return &baker.Config{Domain: container.ID + ".com", Path: "/"}, nil
+	})
+
+	added := make(chan string, 10)
+
+	services := service.New(configLoader, 10*time.Millisecond)
+	go services.Pipe(&ConsumerFn{
+		service: func(service *baker.Service, change baker.Change) error {
+			if change == baker.ServiceAdded {
+				added <- service.Container.ID
+			}
+			return nil
+		},
+		close: func(err error) {},
+	})
+
+	for _, id := range []string{"slow", "fast"} {
+		addr := endpoint.NewAddr("0.0.0.0", 8000, false)
+		services.Container(&baker.Container{
+			ID:       id,
+			Active:   true,
+			Addr:     addr,
+			PingAddr: endpoint.NewHTTPAddr(addr, "/ping"),
+		})
+	}
+
+	select {
+	case id := <-added:
+		if id != "fast" {
+			t.Fatalf("expected fast to be added first but got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast is not added")
+	}
+
+	// fast keeps being pinged on its own while slow is still loading
+	time.Sleep(100 * time.Millisecond)
+
+	mux.Lock()
+	fast, slow := pings["fast"], pings["slow"]
+	mux.Unlock()
+
+	if fast < 3 || slow != 1 {
+		t.Fatalf("expected fast to be pinged many times and slow once but got %d and %d", fast, slow)
+	}
+
+	close(release)
+
+	select {
+	case id := <-added:
+		if id != "slow" {
+			t.Fatalf("expected slow to be added but got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow is not added")
+	}
+}
+
+func TestServicesConfigExpires(t *testing.T) {
+	var pings int32
+
+	configLoader := &expiringConfigLoader{
+		ConfigLoaderFn: func(container *baker.Container) (*baker.Config, error) {
+			atomic.AddInt32(&pings, 1)
+			return &baker.Config{Domain: "example.com", Path: "/"}, nil
+		},
+		expires: time.Now().Add(time.Hour),
+	}
+
+	services := service.New(configLoader, 10*time.Millisecond)
+	go services.Pipe(&ConsumerFn{
+		service: func(service *baker.Service, change baker.Change) error { return nil },
+		close:   func(err error) {},
+	})
+
+	addr := endpoint.NewAddr("0.0.0.0", 8000, false)
+	services.Container(&baker.Container{
+		ID:       "1",
+		Active:   true,
+		Addr:     addr,
+		PingAddr: endpoint.NewHTTPAddr(addr, "/ping"),
+	})
+
+	// container is not pinged again until its config expires
+	time.Sleep(100 * time.Millisecond)
+
+	if pings := atomic.LoadInt32(&pings); pings != 1 {
+		t.Fatalf("expected container to be pinged once but got %d", pings)
+	}
+}
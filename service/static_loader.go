@@ -0,0 +1,25 @@
+package service
+
+import (
+	"github.com/alinz/baker"
+)
+
+// LoadStaticConfig returns the inline config which is given by container's producer
+type LoadStaticConfig struct{}
+
+var _ ConfigLoader = (*LoadStaticConfig)(nil)
+
+// Config returns container's inline config. ErrNoConfig will be returned if
+// container has no inline config
+func (l *LoadStaticConfig) Config(container *baker.Container) (*baker.Config, error) {
+	if container.Config == nil {
+		return nil, ErrNoConfig
+	}
+
+	return container.Config, nil
+}
+
+// NewStaticConfigLoader creates a config loader which uses container's inline config
+func NewStaticConfigLoader() *LoadStaticConfig {
+	return &LoadStaticConfig{}
+}
@@ -0,0 +1,17 @@
+package baker
+
+import (
+	"crypto/tls"
+
+	"github.com/alinz/baker/pkg/endpoint"
+)
+
+// Config creates a tls.Config based on TLS's values.
+// if t is nil, an empty tls.Config will be returned which uses system's roots
+func (t *TLS) Config() (*tls.Config, error) {
+	if t == nil {
+		return &tls.Config{}, nil
+	}
+
+	return endpoint.NewTLSConfig(t.CA, t.Cert, t.Key, t.ServerName, t.InsecureSkipVerify)
+}